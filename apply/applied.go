@@ -0,0 +1,178 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package apply
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/worldiety/nago-runner/configuration"
+	"github.com/worldiety/nago-runner/pkg/linux"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	appliedDir          = "/var/lib/nago-runner/applied"
+	appliedFileSuffix   = ".json"
+	keepAppliedVersions = 10
+)
+
+// appliedConfiguration is the persisted envelope of a successfully applied configuration. The configuration
+// contains secrets, thus the files are only readable by root.
+type appliedConfiguration struct {
+	Version   int       `json:"version"`
+	AppliedAt time.Time `json:"appliedAt"`
+	// Hash of the raw Configuration, which detects a corrupt or partially written file.
+	Hash          configuration.Sha3V512 `json:"hash"`
+	Configuration json.RawMessage        `json:"configuration"`
+}
+
+// AppliedVersion describes a loaded configuration from the history of applied configurations.
+type AppliedVersion struct {
+	Version   int
+	AppliedAt time.Time
+	Hash      configuration.Sha3V512
+}
+
+// SaveAppliedConfiguration appends the given configuration as a new version to the history. Nothing is written,
+// if it equals the latest version. Only the last versions are kept.
+func SaveAppliedConfiguration(cfg configuration.Runner) (AppliedVersion, error) {
+	raw, err := json.Marshal(cfg)
+	if err != nil {
+		return AppliedVersion{}, fmt.Errorf("cannot marshal configuration: %w", err)
+	}
+
+	hash, err := linux.Sha3Bytes(raw)
+	if err != nil {
+		return AppliedVersion{}, err
+	}
+
+	versions, err := appliedVersions()
+	if err != nil {
+		return AppliedVersion{}, err
+	}
+
+	next := 1
+	if len(versions) > 0 {
+		latest := versions[len(versions)-1]
+		if env, err := readAppliedConfiguration(latest); err == nil && env.Hash == hash {
+			return AppliedVersion{Version: env.Version, AppliedAt: env.AppliedAt, Hash: env.Hash}, nil
+		}
+
+		next = latest + 1
+	}
+
+	env := appliedConfiguration{Version: next, AppliedAt: time.Now(), Hash: hash, Configuration: raw}
+	buf, err := json.Marshal(env)
+	if err != nil {
+		return AppliedVersion{}, fmt.Errorf("cannot marshal applied configuration: %w", err)
+	}
+
+	if err := linux.WriteFile(appliedFilename(next), buf, 0600); err != nil {
+		return AppliedVersion{}, fmt.Errorf("cannot write applied configuration: %w", err)
+	}
+
+	versions = append(versions, next)
+	for len(versions) > keepAppliedVersions {
+		_ = os.Remove(appliedFilename(versions[0]))
+		versions = versions[1:]
+	}
+
+	return AppliedVersion{Version: env.Version, AppliedAt: env.AppliedAt, Hash: env.Hash}, nil
+}
+
+// LoadAppliedConfiguration returns the latest applied configuration. If nothing has been applied yet, the error
+// wraps os.ErrNotExist. A corrupt latest version is an error and never replaced by an older version, because an
+// older configuration may not declare instances, which have been added in the meantime, and applying it would
+// purge them.
+func LoadAppliedConfiguration() (configuration.Runner, AppliedVersion, error) {
+	versions, err := appliedVersions()
+	if err != nil {
+		return configuration.Runner{}, AppliedVersion{}, err
+	}
+
+	if len(versions) == 0 {
+		return configuration.Runner{}, AppliedVersion{}, fmt.Errorf("no configuration has been applied yet: %w", os.ErrNotExist)
+	}
+
+	env, err := readAppliedConfiguration(versions[len(versions)-1])
+	if err != nil {
+		return configuration.Runner{}, AppliedVersion{}, err
+	}
+
+	var cfg configuration.Runner
+	if err := json.Unmarshal(env.Configuration, &cfg); err != nil {
+		return configuration.Runner{}, AppliedVersion{}, fmt.Errorf("cannot parse applied configuration: %w", err)
+	}
+
+	return cfg, AppliedVersion{Version: env.Version, AppliedAt: env.AppliedAt, Hash: env.Hash}, nil
+}
+
+// readAppliedConfiguration reads and verifies the given version.
+func readAppliedConfiguration(version int) (appliedConfiguration, error) {
+	fname := appliedFilename(version)
+	buf, err := os.ReadFile(fname)
+	if err != nil {
+		return appliedConfiguration{}, fmt.Errorf("cannot read applied configuration: %w", err)
+	}
+
+	var env appliedConfiguration
+	if err := json.Unmarshal(buf, &env); err != nil {
+		return appliedConfiguration{}, fmt.Errorf("corrupt applied configuration: %s: %w", fname, err)
+	}
+
+	hash, err := linux.Sha3Bytes(env.Configuration)
+	if err != nil {
+		return appliedConfiguration{}, err
+	}
+
+	if env.Version != version || hash != env.Hash {
+		return appliedConfiguration{}, fmt.Errorf("corrupt applied configuration: %s: hash or version mismatch", fname)
+	}
+
+	return env, nil
+}
+
+// appliedVersions returns all persisted versions in ascending order.
+func appliedVersions() ([]int, error) {
+	entries, err := os.ReadDir(appliedDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot read applied configurations: %w", err)
+	}
+
+	var res []int
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), appliedFileSuffix)
+		if !ok {
+			continue
+		}
+
+		// also skips left over tmp files of interrupted writes
+		v, err := strconv.Atoi(name)
+		if err != nil {
+			continue
+		}
+
+		res = append(res, v)
+	}
+
+	slices.Sort(res)
+	return res, nil
+}
+
+func appliedFilename(version int) string {
+	return filepath.Join(appliedDir, fmt.Sprintf("%010d%s", version, appliedFileSuffix))
+}
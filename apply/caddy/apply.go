@@ -9,6 +9,7 @@ package caddy
 
 import (
 	"fmt"
+	"github.com/worldiety/nago-runner/apply"
 	"github.com/worldiety/nago-runner/configuration"
 	"github.com/worldiety/nago-runner/pkg/linux"
 	"github.com/worldiety/nago-runner/pkg/run"
@@ -16,12 +17,14 @@ import (
 	"log/slog"
 )
 
-func Apply(logger *slog.Logger, settings setup.Settings, cfg configuration.Runner) error {
+// Apply renders and reloads the Caddyfile. Instances with changed proxy rules are recorded in the report, which
+// may be nil.
+func Apply(logger *slog.Logger, settings setup.Settings, cfg configuration.Runner, report *apply.Report) error {
 	if err := installCaddy(logger); err != nil {
 		return fmt.Errorf("cannot install caddy: %w", err)
 	}
 
-	updated, err := updateCaddyfile(logger, settings, cfg)
+	updated, err := updateCaddyfile(logger, settings, cfg, report)
 	if err != nil {
 		return fmt.Errorf("cannot update caddyfile: %w", err)
 	}
@@ -0,0 +1,36 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package caddy
+
+import (
+	"fmt"
+	"github.com/worldiety/nago-runner/apply"
+	"github.com/worldiety/nago-runner/configuration"
+	"github.com/worldiety/nago-runner/pkg/diff"
+	"github.com/worldiety/nago-runner/service/event"
+)
+
+// Plan calculates how the generated Caddyfile would change, if the given configuration is applied. It returns
+// nil if the Caddyfile is already up to date.
+func Plan(cfg configuration.Runner) ([]event.FileChange, error) {
+	upstreams, err := apply.LoadUpstreams()
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := diff.File(caddyFile, []byte(renderCaddyfile(cfg, upstreams)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot diff caddyfile: %w", err)
+	}
+
+	if d == "" {
+		return nil, nil
+	}
+
+	return []event.FileChange{{Filename: caddyFile, Diff: d}}, nil
+}
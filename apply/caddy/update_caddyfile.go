@@ -9,35 +9,40 @@ package caddy
 
 import (
 	"fmt"
+	"github.com/worldiety/nago-runner/apply"
 	"github.com/worldiety/nago-runner/configuration"
 	"github.com/worldiety/nago-runner/pkg/linux"
+	"github.com/worldiety/nago-runner/service/event"
 	"github.com/worldiety/nago-runner/setup"
 	"log/slog"
+	"os"
+	"strings"
 )
 
-func updateCaddyfile(logger *slog.Logger, settings setup.Settings, cfg configuration.Runner) (bool, error) {
-	var tmp string
-	// note that caddy is not able to start with zero byte config file, thus emit some comments
-	tmp += "# Code generated by \"nago-runner\"; DO NOT EDIT.\n\n"
-	for _, application := range cfg.Applications {
-		if !application.ReverseProxy.Enabled {
-			continue
-		}
+const caddyFile = "/etc/caddy/Caddyfile"
 
-		for _, rule := range application.ReverseProxy.Rules {
-			if rule.Redirect {
-				tmp += caddyRedirect(rule)
-			} else {
-				tmp += caddyProxy(rule)
-			}
-		}
+func updateCaddyfile(logger *slog.Logger, settings setup.Settings, cfg configuration.Runner, report *apply.Report) (bool, error) {
+	upstreams, err := apply.LoadUpstreams()
+	if err != nil {
+		return false, err
 	}
 
-	caddyFile := "/etc/caddy/Caddyfile"
+	tmp := renderCaddyfile(cfg, upstreams)
 	if linux.EqualBuf(caddyFile, []byte(tmp)) {
 		return false, nil
 	}
 
+	// the rules of an instance have changed, if its rendered block is not yet part of the current file
+	current, _ := os.ReadFile(caddyFile)
+	for _, application := range cfg.Applications {
+		block := renderApplication(application, upstreams)
+		if block != "" && !strings.Contains(string(current), block) {
+			report.Update(application.InstID, func(instance *event.InstanceApplied) {
+				instance.Changes.ProxyRules = true
+			})
+		}
+	}
+
 	if err := linux.WriteFile(caddyFile, []byte(tmp), 0644); err != nil {
 		return false, fmt.Errorf("caddyfile: failed to write caddy file to %s: %s", caddyFile, err)
 	}
@@ -47,12 +52,71 @@ func updateCaddyfile(logger *slog.Logger, settings setup.Settings, cfg configura
 	return true, nil
 }
 
-func caddyProxy(rule configuration.Rule) string {
+// renderCaddyfile generates the entire Caddyfile content for all declared reverse proxy rules. Instances with
+// upstreams are proxied to these ports instead of their declared rule port.
+func renderCaddyfile(cfg configuration.Runner, upstreams apply.Upstreams) string {
+	var tmp string
+	// note that caddy is not able to start with zero byte config file, thus emit some comments
+	tmp += "# Code generated by \"nago-runner\"; DO NOT EDIT.\n\n"
+	for _, application := range cfg.Applications {
+		tmp += renderApplication(application, upstreams)
+	}
+
+	return tmp
+}
+
+// renderApplication generates the site blocks of all reverse proxy rules of the given application.
+func renderApplication(application configuration.Application, upstreams apply.Upstreams) string {
+	if !application.ReverseProxy.Enabled {
+		return ""
+	}
+
+	var tmp string
+	for _, rule := range application.ReverseProxy.Rules {
+		if rule.Redirect {
+			tmp += caddyRedirect(rule)
+		} else {
+			tmp += caddyProxy(rule, upstreams[application.InstID], loadBalancing(application))
+		}
+	}
+
+	return tmp
+}
+
+// loadBalancing returns the lb_policy of a replicated application or the empty string.
+func loadBalancing(application configuration.Application) string {
+	if application.Replicas.Count <= 0 || application.Replicas.Validate() != nil {
+		return ""
+	}
+
+	return application.Replicas.Policy()
+}
+
+func caddyProxy(rule configuration.Rule, ports []int, policy string) string {
+	if len(ports) == 0 {
+		ports = []int{rule.Port}
+	}
+
+	var targets []string
+	for _, port := range ports {
+		targets = append(targets, fmt.Sprintf("%s:%d", rule.Host, port))
+	}
+
+	if policy == "" {
+		return fmt.Sprintf(`
+%s {
+	reverse_proxy %s
+}
+`, rule.Location, strings.Join(targets, " "))
+	}
+
 	return fmt.Sprintf(`
 %s {
-	reverse_proxy %s:%d
+	reverse_proxy %s {
+		lb_policy %s
+	}
 }
-`, rule.Location, rule.Host, rule.Port)
+`, rule.Location, strings.Join(targets, " "), policy)
 }
 
 func caddyRedirect(rule configuration.Rule) string {
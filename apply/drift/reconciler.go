@@ -0,0 +1,141 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package drift
+
+import (
+	"context"
+	"fmt"
+	"github.com/worldiety/nago-runner/apply/caddy"
+	"github.com/worldiety/nago-runner/apply/systemd"
+	"github.com/worldiety/nago-runner/configuration"
+	"github.com/worldiety/nago-runner/service/event"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const defaultInterval = 5 * time.Minute
+
+// Repair applies the given configuration again. It is invoked while holding the apply lock of the Reconciler.
+type Repair func(cfg configuration.Runner) error
+
+// Reconciler periodically compares the actual state of the machine with the last applied configuration and
+// publishes an event.DriftDetected, if they differ. Depending on configuration.Reconciliation, the drift is
+// repaired as well.
+type Reconciler struct {
+	bus    event.Bus
+	lock   sync.Locker
+	repair Repair
+	mutex  sync.Mutex
+	cancel context.CancelFunc
+}
+
+// NewReconciler creates a Reconciler, which holds the given lock while comparing or repairing, so that it never
+// observes a half applied configuration.
+func NewReconciler(bus event.Bus, lock sync.Locker, repair Repair) *Reconciler {
+	return &Reconciler{bus: bus, lock: lock, repair: repair}
+}
+
+// Update replaces the configuration to compare with and restarts the loop. The loop stops when ctx is done.
+func (r *Reconciler) Update(ctx context.Context, cfg configuration.Runner) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.cancel != nil {
+		r.cancel()
+	}
+
+	loopCtx, cancel := context.WithCancel(ctx)
+	r.cancel = cancel
+	go r.run(loopCtx, cfg)
+}
+
+func (r *Reconciler) run(ctx context.Context, cfg configuration.Runner) {
+	interval := cfg.Reconciliation.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		r.reconcile(ctx, cfg)
+	}
+}
+
+func (r *Reconciler) reconcile(ctx context.Context, cfg configuration.Runner) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// the configuration may have been replaced while waiting for the lock
+	if ctx.Err() != nil {
+		return
+	}
+
+	evt, err := Detect(cfg)
+	if err != nil {
+		slog.Error("cannot detect drift", "err", err.Error())
+		return
+	}
+
+	if evt.Plan.Empty() && len(evt.Services) == 0 {
+		slog.Info("no drift detected")
+		return
+	}
+
+	slog.Warn("drift detected", "files", len(evt.Plan.Files), "executables", len(evt.Plan.Executables), "purges", len(evt.Plan.Purges), "services", len(evt.Services))
+	if cfg.Reconciliation.Repair {
+		if err := r.repair(cfg); err != nil {
+			slog.Error("cannot repair drift", "err", err.Error())
+			evt.Error = err.Error()
+		} else {
+			// applying does not start unchanged services, thus start those which are still stopped
+			services, err := systemd.ServiceDrift(cfg)
+			if err != nil {
+				evt.Error = err.Error()
+			} else {
+				systemd.StartServices(slog.Default(), services)
+				evt.Repaired = true
+			}
+		}
+	}
+
+	r.bus.Publish(evt)
+}
+
+// Detect compares the actual state of the machine with the given configuration without changing anything.
+func Detect(cfg configuration.Runner) (event.DriftDetected, error) {
+	var evt event.DriftDetected
+	plan, err := systemd.Plan(slog.Default(), cfg)
+	if err != nil {
+		return evt, fmt.Errorf("cannot plan systemd configuration: %w", err)
+	}
+
+	caddyChanges, err := caddy.Plan(cfg)
+	if err != nil {
+		return evt, fmt.Errorf("cannot plan caddy configuration: %w", err)
+	}
+
+	plan.Files = append(plan.Files, caddyChanges...)
+
+	services, err := systemd.ServiceDrift(cfg)
+	if err != nil {
+		return evt, fmt.Errorf("cannot inspect services: %w", err)
+	}
+
+	evt.Plan = plan
+	evt.Services = services
+	return evt, nil
+}
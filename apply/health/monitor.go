@@ -0,0 +1,127 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package health
+
+import (
+	"context"
+	"github.com/worldiety/nago-runner/configuration"
+	"github.com/worldiety/nago-runner/service/event"
+	"log/slog"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInterval         = 10 * time.Second
+	defaultFailureThreshold = 3
+)
+
+// Monitor probes the declared health checks of all instances periodically and publishes an event.HealthChanged
+// whenever the state of an instance changes.
+type Monitor struct {
+	bus    event.Bus
+	mutex  sync.Mutex
+	checks map[string]*check
+}
+
+type check struct {
+	decl   configuration.HealthCheck
+	cancel context.CancelFunc
+}
+
+func NewMonitor(bus event.Bus) *Monitor {
+	return &Monitor{bus: bus, checks: map[string]*check{}}
+}
+
+// Update starts, restarts or stops the checks, so that exactly the declared health checks of the given
+// configuration are probed. Unchanged checks keep running and keep their state. All checks stop when ctx is done.
+func (m *Monitor) Update(ctx context.Context, cfg configuration.Runner) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	declared := map[string]configuration.HealthCheck{}
+	for _, app := range cfg.Applications {
+		if app.HealthCheck.Enabled && app.HealthCheck.Probe.Declared() {
+			declared[app.InstID] = app.HealthCheck
+		}
+	}
+
+	for instID, c := range m.checks {
+		if decl, ok := declared[instID]; ok && reflect.DeepEqual(decl, c.decl) {
+			continue
+		}
+
+		c.cancel()
+		delete(m.checks, instID)
+	}
+
+	for instID, decl := range declared {
+		if _, ok := m.checks[instID]; ok {
+			continue
+		}
+
+		checkCtx, cancel := context.WithCancel(ctx)
+		m.checks[instID] = &check{decl: decl, cancel: cancel}
+		go m.run(checkCtx, instID, decl)
+	}
+}
+
+func (m *Monitor) run(ctx context.Context, instID string, decl configuration.HealthCheck) {
+	interval := decl.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+
+	threshold := decl.FailureThreshold
+	if threshold <= 0 {
+		threshold = defaultFailureThreshold
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var status event.HealthStatus
+	failures := 0
+	for {
+		err := Probe(ctx, decl.Probe)
+		if ctx.Err() != nil {
+			return
+		}
+
+		next := status
+		if err == nil {
+			failures = 0
+			next = event.Healthy
+		} else {
+			failures++
+			if failures >= threshold {
+				next = event.Unhealthy
+			}
+		}
+
+		if next != status {
+			status = next
+			evt := event.HealthChanged{InstanceID: instID, Status: status, Failures: failures}
+			if err != nil {
+				evt.Error = err.Error()
+				slog.Warn("instance became unhealthy", "instance", instID, "failures", failures, "err", err.Error())
+			} else {
+				slog.Info("instance became healthy", "instance", instID)
+			}
+
+			m.bus.Publish(evt)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+// Package health contains the local checks, whether an application actually serves requests.
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/worldiety/nago-runner/configuration"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const defaultTimeout = 5 * time.Second
+
+// Probe executes the given probe once and returns an error, if the application is not healthy.
+func Probe(ctx context.Context, probe configuration.Probe) error {
+	timeout := probe.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	switch {
+	case probe.HTTP != "":
+		return probeHTTP(ctx, string(probe.HTTP))
+	case probe.TCP != "":
+		return probeTCP(ctx, probe.TCP)
+	case probe.Exec.Cmd != "":
+		return probeExec(ctx, probe.Exec)
+	default:
+		return errors.New("probe has no check declared")
+	}
+}
+
+func probeHTTP(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("cannot create http probe request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("http probe failed: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("http probe returned unexpected status: %s", resp.Status)
+	}
+
+	return nil
+}
+
+func probeTCP(ctx context.Context, addr string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("tcp probe failed: %w", err)
+	}
+
+	return conn.Close()
+}
+
+func probeExec(ctx context.Context, cmd configuration.Command) error {
+	out, err := exec.CommandContext(ctx, cmd.Cmd, cmd.Args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec probe failed: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+
+	return nil
+}
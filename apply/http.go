@@ -9,9 +9,11 @@ package apply
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/worldiety/nago-runner/configuration"
 	"github.com/worldiety/nago-runner/setup"
 	"net/http"
+	"net/url"
 	"time"
 )
 
@@ -43,3 +45,36 @@ func QueryConfiguration(settings setup.Settings) (configuration.Runner, error) {
 
 	return cfg, nil
 }
+
+// QueryFileSet resolves the declared FileSetID into the actual files.
+func QueryFileSet(settings setup.Settings, id configuration.FileSetID) (configuration.FileSet, error) {
+	req, err := http.NewRequest("GET", settings.Endpoints().Http("api/v1/configuration/fileset?id="+url.QueryEscape(string(id))), nil)
+	if err != nil {
+		return configuration.FileSet{}, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+settings.Token)
+
+	client := &http.Client{
+		Timeout: time.Second * 30,
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return configuration.FileSet{}, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return configuration.FileSet{}, fmt.Errorf("unexpected http response when querying file set: %s", resp.Status)
+	}
+
+	var set configuration.FileSet
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(&set); err != nil {
+		return configuration.FileSet{}, err
+	}
+
+	return set, nil
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package purge
+
+import (
+	"context"
+	"github.com/worldiety/nago-runner/apply/systemd"
+	"github.com/worldiety/nago-runner/service/event"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const interval = 10 * time.Minute
+
+// Purger periodically takes the final backups of all tombstones and deletes those, which are due. See also
+// configuration.Purge.
+type Purger struct {
+	bus    event.Bus
+	lock   sync.Locker
+	backup systemd.FinalBackup
+	// wake triggers a purge by Run, so that confirmations never purge concurrently with the periodic purge.
+	wake chan struct{}
+}
+
+// NewPurger creates a Purger, which holds the given lock while deleting, so that an instance is never deleted
+// while it gets declared again.
+func NewPurger(bus event.Bus, lock sync.Locker, backup systemd.FinalBackup) *Purger {
+	return &Purger{bus: bus, lock: lock, backup: backup, wake: make(chan struct{}, 1)}
+}
+
+// Run purges periodically until ctx is done.
+func (p *Purger) Run(ctx context.Context) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.wake:
+		}
+
+		p.purge()
+	}
+}
+
+// Confirm marks the given tombstone to be deleted by Run right away, without waiting for its grace period or its
+// final backup. It does not block, thus it can be called from a bus subscriber.
+func (p *Purger) Confirm(instID string) {
+	if err := systemd.ConfirmPurge(instID); err != nil {
+		slog.Error("cannot confirm purge", "instance", instID, "err", err.Error())
+		p.bus.Publish(event.InstancePurged{InstanceID: instID, Confirmed: true, Error: err.Error()})
+		return
+	}
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+		// a purge is already pending and will also delete this tombstone
+	}
+}
+
+func (p *Purger) purge() {
+	// backups may take long and must not block applying
+	if err := systemd.BackupTombstones(slog.Default(), p.backup); err != nil {
+		slog.Error("cannot backup tombstones", "err", err.Error())
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err := systemd.PurgeTombstones(slog.Default(), p.bus); err != nil {
+		slog.Error("cannot purge tombstones", "err", err.Error())
+	}
+}
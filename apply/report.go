@@ -0,0 +1,133 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package apply
+
+import (
+	"github.com/worldiety/nago-runner/configuration"
+	"github.com/worldiety/nago-runner/service/event"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Report collects the outcome of applying a configuration per instance. It is safe for concurrent use and all
+// methods of a nil Report do nothing, so that partial applies like a proxy switch do not need to report.
+type Report struct {
+	mutex sync.Mutex
+	evt   event.ApplyCompleted
+}
+
+// NewReport creates a report for all instances declared in the given configuration.
+func NewReport(cfg configuration.Runner) *Report {
+	r := &Report{evt: event.ApplyCompleted{StartedAt: time.Now()}}
+	for _, app := range cfg.Applications {
+		r.evt.Instances = append(r.evt.Instances, event.InstanceApplied{InstanceID: app.InstID, AppID: app.AppID})
+	}
+
+	return r
+}
+
+// Update modifies the report of the given instance. Undeclared instances are ignored.
+func (r *Report) Update(instID string, fn func(instance *event.InstanceApplied)) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	idx := slices.IndexFunc(r.evt.Instances, func(instance event.InstanceApplied) bool {
+		return instance.InstanceID == instID
+	})
+
+	if idx < 0 {
+		return
+	}
+
+	fn(&r.evt.Instances[idx])
+}
+
+// Step executes fn as a named step of the instance and records its duration and error. The error of the first
+// failed step also becomes the error of the instance.
+func (r *Report) Step(instID string, name string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	step := event.ApplyStep{Name: name, Duration: time.Since(start)}
+	if err != nil {
+		step.Error = err.Error()
+	}
+
+	r.Update(instID, func(instance *event.InstanceApplied) {
+		instance.Steps = append(instance.Steps, step)
+		if err != nil && instance.Error == "" {
+			instance.Error = err.Error()
+		}
+	})
+
+	return err
+}
+
+// Fail records the error for the instance, if it has no error yet.
+func (r *Report) Fail(instID string, err error) {
+	r.Update(instID, func(instance *event.InstanceApplied) {
+		if instance.Error == "" {
+			instance.Error = err.Error()
+		}
+	})
+}
+
+// Restarted records a (re)started unit of the instance.
+func (r *Report) Restarted(instID string, unit string) {
+	r.Update(instID, func(instance *event.InstanceApplied) {
+		instance.Restarted = append(instance.Restarted, unit)
+	})
+}
+
+// Purged records an undeclared instance, which has been removed.
+func (r *Report) Purged(instID string) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// an instance may own multiple units, like a service and its jobs
+	if !slices.Contains(r.evt.Purged, instID) {
+		r.evt.Purged = append(r.evt.Purged, instID)
+	}
+}
+
+// Tombstoned records an undeclared instance, which has been stopped and whose data is deleted later.
+func (r *Report) Tombstoned(instID string) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !slices.Contains(r.evt.Tombstoned, instID) {
+		r.evt.Tombstoned = append(r.evt.Tombstoned, instID)
+	}
+}
+
+// Complete returns the final event with the overall error of the apply, which may be nil.
+func (r *Report) Complete(err error) event.ApplyCompleted {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	evt := r.evt
+	evt.Instances = slices.Clone(evt.Instances)
+	evt.Duration = time.Since(evt.StartedAt)
+	if err != nil {
+		evt.Error = err.Error()
+	}
+
+	return evt
+}
@@ -8,72 +8,261 @@
 package systemd
 
 import (
+	"errors"
 	"fmt"
+	"github.com/worldiety/nago-runner/apply"
 	"github.com/worldiety/nago-runner/configuration"
 	"github.com/worldiety/nago-runner/pkg/run"
+	"github.com/worldiety/nago-runner/service/event"
 	"github.com/worldiety/nago-runner/setup"
 	"log/slog"
 	"os"
+	"path/filepath"
 	"slices"
+	"strings"
 )
 
 const systemdConfDir = "/etc/systemd/system"
 
-func Apply(logger *slog.Logger, settings setup.Settings, cfg configuration.Runner) error {
-	keepServices, removeServices, err := categorizeServices(logger, cfg)
+// Apply reconciles all managed units with the given configuration. Instances which are deployed blue/green or
+// replicated call switchProxy, whenever their traffic has to be moved to other ports. Instances are updated,
+// started and restarted after the instances they depend on. The outcome of each instance is recorded
+// in the report, which may be nil. An instance which cannot be updated is skipped and the others are applied
+// anyway, thus the returned error joins all failures. A declaration, which has been rolled back, is skipped until
+// it changes.
+func Apply(logger *slog.Logger, settings setup.Settings, bus event.Bus, cfg configuration.Runner, switchProxy ProxySwitch, report *apply.Report) error {
+	// the instances are handled in the order of their dependencies
+	apps, err := resolveDependencies(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid dependencies: %w", err)
+	}
+
+	apps = resolveSlices(apps)
+
+	keepServices, removeServices, staleServices, err := categorizeServices(logger, cfg)
 	if err != nil {
 		return fmt.Errorf("cannot categorize services: %w", err)
 	}
 
-	if err := purgeServices(logger, removeServices); err != nil {
-		return fmt.Errorf("cannot purge services: %w", err)
+	upstreams, err := apply.LoadUpstreams()
+	if err != nil {
+		return err
+	}
+
+	// undeclared instances are only stopped, their data is deleted later by PurgeTombstones
+	if err := tombstoneServices(logger, cfg.Purge, countInstances(keepServices, staleServices), removeServices, report); err != nil {
+		return fmt.Errorf("cannot remove services: %w", err)
 	}
 
 	for _, service := range keepServices {
 		logger.Info("apply service", "name", service.Name())
 	}
 
-	var requiresRestart []Service
-	for _, app := range cfg.Applications {
-		service, changed, err := createOrUpdateService(logger, settings, app)
-		if err != nil {
-			return fmt.Errorf("cannot create or update service: %w", err)
+	// slices must exist before the services are moved into them
+	slicesChanged, err := updateSlices(logger, cfg)
+	if err != nil {
+		return fmt.Errorf("cannot update slices: %w", err)
+	}
+
+	if err := forgetRollbacks(logger, apps); err != nil {
+		return fmt.Errorf("cannot update rollbacks: %w", err)
+	}
+
+	// a failed instance is recorded and skipped, thus it cannot hold back the rollout of all other instances
+	var errs []error
+	failed := map[string]bool{}
+
+	// weakly sandboxed units must not go live, thus they are audited before anything is installed
+	refused, err := auditSecurity(logger, cfg.Security, apps, report)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	var requiresRestart []deployment
+	var blueGreen []deployment
+	var replicated []deployment
+	var timers []string
+	for _, app := range apps {
+		if refused[app.InstID] {
+			failed[app.InstID] = true
+			continue
 		}
 
-		if !changed {
-			logger.Info("service is unchanged", "service", service.Name())
+		// the previous version keeps running, instead of installing the broken one again
+		if hash, err := rolledBackDeclaration(app); err != nil || hash != "" {
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", app.InstID, err))
+			}
+
+			logger.Warn("skipping rolled back declaration", "instance", app.InstID, "hash", hash)
+			report.Update(app.InstID, func(instance *event.InstanceApplied) {
+				instance.RolledBackHash = string(hash)
+			})
+			failed[app.InstID] = true
+			continue
+		}
+
+		service, changes, err := createOrUpdateService(logger, settings, bus, app, report)
+		if err != nil {
+			logger.Error("cannot create or update service", "instance", app.InstID, "err", err.Error())
+			errs = append(errs, fmt.Errorf("cannot create or update service: %s: %w", app.InstID, err))
+			failed[app.InstID] = true
 			continue
 		}
 
-		requiresRestart = append(requiresRestart, service)
+		timers = append(timers, changes.Timers...)
+		for _, timer := range changes.Timers {
+			report.Restarted(app.InstID, timer)
+		}
+
+		d := deployment{app: app, service: service, changes: changes}
+		switch {
+		case usesBlueGreen(app) && (changes.Any() || activeSlot(app, upstreams) == ""):
+			blueGreen = append(blueGreen, d)
+		case usesReplicas(app) && (changes.Any() || !replicasServing(app, upstreams)):
+			replicated = append(replicated, d)
+		case usesBlueGreen(app) || usesReplicas(app) || !changes.Any():
+			logger.Info("service is unchanged", "service", service.Name())
+		default:
+			requiresRestart = append(requiresRestart, d)
+		}
 	}
 
 	// this optimizes mass-updates to O(1) systemd reloads
-	if len(requiresRestart) > 0 {
+	if len(requiresRestart) > 0 || len(blueGreen) > 0 || len(replicated) > 0 || len(timers) > 0 || slicesChanged {
 		if err := run.Command("systemctl", "daemon-reload"); err != nil {
 			return fmt.Errorf("error reloading systemd daemon: %w", err)
 		}
+	}
+
+	for _, timer := range timers {
+		logger.Info("restart timer", "timer", timer)
+		if err := run.Command("systemctl", "enable", timer); err != nil {
+			slog.Warn("failed to enable timer, ignoring", "timer", timer)
+		}
+
+		if err := run.Command("systemctl", "restart", timer); err != nil {
+			slog.Warn("failed to restart timer, ignoring", "timer", timer)
+		}
+	}
 
-		for _, service := range requiresRestart {
+	if len(requiresRestart) > 0 {
+		for _, d := range requiresRestart {
+			if usesSocket(d.app) {
+				restartSocketActivated(logger, d)
+				report.Restarted(d.app.InstID, d.app.InstID+".socket")
+				continue
+			}
+
+			service := d.service
 			logger.Info("enable service", "service", service.Name())
 			if err := run.Command("systemctl", "enable", service.Name()); err != nil {
 				slog.Warn("failed to enable service, ignoring", "service", service.Name())
 			}
 
-			logger.Info("restart service", "service", service.Name())
-			if err := run.Command("systemctl", "restart", service.Name()); err != nil {
-				slog.Warn("failed to restart service, ignoring", "service", service.Name())
-			}
+			// a failed restart is reported but the rollout continues, the rollback may still recover it
+			_ = report.Step(d.app.InstID, "restart", func() error {
+				return restartService(logger, service.Name())
+			})
+
+			report.Restarted(d.app.InstID, service.Name())
+		}
+
+		verifyDeployments(logger, bus, requiresRestart, report)
+	}
+
+	for _, d := range blueGreen {
+		err := report.Step(d.app.InstID, "blueGreen", func() error {
+			return deployBlueGreen(logger, bus, d, upstreams, switchProxy, report)
+		})
+
+		if err != nil {
+			logger.Error("blue/green deployment failed", "instance", d.app.InstID, "err", err.Error())
+			errs = append(errs, fmt.Errorf("%s: %w", d.app.InstID, err))
+			failed[d.app.InstID] = true
+		}
+	}
+
+	for _, d := range replicated {
+		err := report.Step(d.app.InstID, "replicas", func() error {
+			return deployReplicas(logger, bus, d, upstreams, switchProxy, report)
+		})
+
+		if err != nil {
+			logger.Error("replica deployment failed", "instance", d.app.InstID, "err", err.Error())
+			errs = append(errs, fmt.Errorf("%s: %w", d.app.InstID, err))
+			failed[d.app.InstID] = true
+		}
+	}
+
+	if err := releaseUpstreams(logger, cfg, upstreams, switchProxy); err != nil {
+		errs = append(errs, err)
+	}
+
+	// stale units still serve the traffic, if the replacing deployment has failed
+	if err := removeStaleServices(logger, staleServices, failed); err != nil {
+		errs = append(errs, fmt.Errorf("cannot remove stale services: %w", err))
+	}
+
+	if err := removeSlices(logger, cfg); err != nil {
+		errs = append(errs, fmt.Errorf("cannot remove slices: %w", err))
+	}
+
+	reportLimits(logger, cfg, upstreams, report)
+
+	// quotas require a resolvable service user, thus apply them after starting
+	if err := updateQuotas(logger, cfg, report); err != nil {
+		errs = append(errs, fmt.Errorf("cannot update quotas: %w", err))
+	}
+
+	// blobs of undeclared builds are kept for a while, so that a rollback does not require a download
+	if err := collectBlobs(logger, cfg); err != nil {
+		logger.Error("cannot collect unreferenced blobs", "err", err.Error())
+	}
+
+	return errors.Join(errs...)
+}
+
+// releaseUpstreams removes the upstreams of all instances, which are neither deployed blue/green nor replicated
+// anymore, so that the proxy uses their declared ports again.
+func releaseUpstreams(logger *slog.Logger, cfg configuration.Runner, upstreams apply.Upstreams, switchProxy ProxySwitch) error {
+	changed := false
+	for instID := range upstreams {
+		idx := slices.IndexFunc(cfg.Applications, func(app configuration.Application) bool {
+			return app.InstID == instID
+		})
+
+		if idx >= 0 && (usesBlueGreen(cfg.Applications[idx]) || usesReplicas(cfg.Applications[idx])) {
+			continue
 		}
+
+		logger.Info("releasing upstreams", "instance", instID)
+		delete(upstreams, instID)
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	if err := upstreams.Save(); err != nil {
+		return err
+	}
+
+	if err := switchProxy(); err != nil {
+		return fmt.Errorf("cannot switch proxy to declared ports: %w", err)
 	}
 
 	return nil
 }
 
-func categorizeServices(logger *slog.Logger, cfg configuration.Runner) (keep []Service, remove []Service, err error) {
+// categorizeServices splits the managed units into the units to keep, the units of undeclared instances which are
+// purged including their data and the stale units of declared instances, which are not generated anymore, e.g.
+// undeclared jobs or after the deployment strategy has changed.
+func categorizeServices(logger *slog.Logger, cfg configuration.Runner) (keep []Service, remove []Service, stale []Service, err error) {
 	allServices, err := FindServices(logger)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to find systemd units: %w", err)
+		return nil, nil, nil, fmt.Errorf("failed to find systemd units: %w", err)
 	}
 
 	for _, service := range allServices {
@@ -82,21 +271,108 @@ func categorizeServices(logger *slog.Logger, cfg configuration.Runner) (keep []S
 			continue
 		}
 
-		stillAvailable := slices.ContainsFunc(cfg.Applications, func(app configuration.Application) bool {
-			return app.InstID == service.Name()
+		idx := slices.IndexFunc(cfg.Applications, func(app configuration.Application) bool {
+			return app.InstID == service.InstanceID()
 		})
 
-		if stillAvailable {
-			keep = append(keep, service)
-		} else {
+		switch {
+		case idx < 0:
 			remove = append(remove, service)
+		case !slices.Contains(unitFiles(cfg.Applications[idx]), strings.ToLower(filepath.Base(service.UnitFilename))):
+			stale = append(stale, service)
+		default:
+			keep = append(keep, service)
+		}
+	}
+
+	return keep, remove, stale, nil
+}
+
+// removeStaleServices stops and removes the unit files of declared instances, which are not generated anymore.
+// In contrast to purging, the executable and the data of the instance are kept. Instances contained in skip are
+// left untouched.
+func removeStaleServices(logger *slog.Logger, stale []Service, skip map[string]bool) error {
+	removed := 0
+	var activate []string
+	for _, service := range stale {
+		if skip[service.InstanceID()] {
+			logger.Warn("keeping stale service", "service", service.Name())
+			continue
+		}
+
+		logger.Info("removing stale service", "service", service.Name())
+		if err := run.Command("systemctl", "stop", service.Unit()); err != nil {
+			slog.Warn("failed to stop service, ignoring", "service", service.Name())
+		}
+
+		if err := disableService(service); err != nil {
+			return err
+		}
+
+		if err := os.RemoveAll(service.UnitFilename); err != nil {
+			return fmt.Errorf("failed to remove service file:%s: %w", service.UnitFilename, err)
+		}
+
+		_ = os.Remove(service.UnitFilename + prevSuffix)
+		// e.g. the drop-ins of <inst>.service after switching to blue/green, they are written to <inst>@.service.d
+		_ = os.RemoveAll(service.UnitFilename + ".d")
+		removed++
+
+		// without its socket, the service must be running to listen by itself
+		if service.Type() == "socket" {
+			if _, err := os.Stat(filepath.Join(systemdConfDir, service.InstanceID()+".service")); err == nil {
+				activate = append(activate, service.InstanceID())
+			}
+		}
+	}
+
+	if removed > 0 {
+		if err := run.Command("systemctl", "daemon-reload"); err != nil {
+			return fmt.Errorf("error reloading systemd daemon: %w", err)
+		}
+	}
+
+	for _, name := range activate {
+		logger.Info("start formerly socket activated service", "service", name)
+		if err := run.Command("systemctl", "enable", name); err != nil {
+			slog.Warn("failed to enable service, ignoring", "service", name)
+		}
+
+		if err := run.Command("systemctl", "restart", name); err != nil {
+			slog.Warn("failed to restart service, ignoring", "service", name)
+		}
+	}
+
+	return nil
+}
+
+// disableService removes the enablement of the unit. The slots of a template are disabled all at once.
+func disableService(service Service) error {
+	if service.Template() {
+		return removeSlots(service.InstanceID())
+	}
+
+	if err := run.Command("systemctl", "disable", service.Unit()); err != nil {
+		slog.Warn("failed to disable service, ignoring", "service", service.Name())
+	}
+
+	return nil
+}
+
+// countInstances returns the number of distinct instances, which own the given units.
+func countInstances(services ...[]Service) int {
+	instances := map[string]bool{}
+	for _, list := range services {
+		for _, service := range list {
+			instances[service.InstanceID()] = true
 		}
 	}
 
-	return keep, remove, nil
+	return len(instances)
 }
 
-func purgeServices(logger *slog.Logger, toRemove []Service) error {
+// purgeServices deletes the units, the executables and the data of the given services for good.
+func purgeServices(logger *slog.Logger, toRemove []Service, report *apply.Report) error {
 	var deletedServices int
 
 	for _, service := range toRemove {
@@ -105,10 +381,14 @@ func purgeServices(logger *slog.Logger, toRemove []Service) error {
 		logger.Warn("removing undeclared managed service", "service", service.Name())
 
 		logger.Info("stopping service", "service", service.Name())
-		if err := run.Command("systemctl", "stop", service.Name()); err != nil {
+		if err := run.Command("systemctl", "stop", service.Unit()); err != nil {
 			slog.Warn("failed to stop service, ignoring", "service", service.Name())
 		}
 
+		if err := disableService(service); err != nil {
+			return err
+		}
+
 		paths := service.Paths()
 		logger.Info("removing exec", "file", paths.ExecFilename)
 		if err := os.RemoveAll(paths.ExecFilename); err != nil {
@@ -125,6 +405,19 @@ func purgeServices(logger *slog.Logger, toRemove []Service) error {
 			return fmt.Errorf("failed to remove service file:%s: %w", service.UnitFilename, err)
 		}
 
+		// also clean up the versions kept for a rollback and the build workspace
+		_ = os.Remove(paths.ExecFilename + prevSuffix)
+		_ = os.Remove(service.UnitFilename + prevSuffix)
+		_ = os.RemoveAll(service.UnitFilename + ".d")
+		_ = os.RemoveAll(newBuildWorkspace(service.InstanceID()).dir)
+		_ = os.RemoveAll(newArtifactLayout(service.InstanceID()).dir)
+		_ = os.RemoveAll(filepath.Join(credentialsDir, service.InstanceID()))
+		_ = os.RemoveAll(filepath.Join(slotsDir, service.InstanceID()))
+		if err := forgetRestore(service.InstanceID()); err != nil {
+			logger.Error("cannot forget restore state", "service", service.Name(), "err", err.Error())
+		}
+
+		report.Purged(service.InstanceID())
 		deletedServices++
 	}
 
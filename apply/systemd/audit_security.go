@@ -0,0 +1,191 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package systemd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/worldiety/nago-runner/apply"
+	"github.com/worldiety/nago-runner/configuration"
+	"github.com/worldiety/nago-runner/pkg/linux"
+	"github.com/worldiety/nago-runner/pkg/run"
+	"github.com/worldiety/nago-runner/service/event"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+const refusalsFile = "/var/lib/nago-runner/refused.json"
+
+// auditSecurity analyzes the rendered main unit of every instance offline, before anything is installed, and
+// records the exposure in the report. Units exceeding the maximum exposure of the runner are flagged or, if the
+// policy is enforced, refused: they never go live and the running units of their instance are stopped and
+// disabled. A unit, which cannot be analyzed, is refused as well under an enforced policy and otherwise only
+// reported. The refused instances are returned and persisted for the drift detection. A missing systemd-analyze
+// only skips the audit.
+func auditSecurity(logger *slog.Logger, policy configuration.Security, apps []configuration.Application, report *apply.Report) (map[string]bool, error) {
+	refused := map[string]bool{}
+	path, err := linux.Which("systemd-analyze")
+	if err != nil || path == "" {
+		logger.Warn("systemd-analyze executable not found in $PATH, skipping security audit")
+		return refused, saveRefusals(refused)
+	}
+
+	dir, err := os.MkdirTemp("", "ngr-audit-")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create audit directory: %w", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	var errs []error
+	for _, app := range apps {
+		unit := auditedUnit(app)
+		analysis, err := analyzeUnit(dir, app, unit)
+		if err != nil {
+			logger.Error("cannot audit security", "unit", unit, "err", err.Error())
+			err := fmt.Errorf("%s: cannot audit security: %w", unit, err)
+			audit := &event.SecurityAudit{Unit: unit, Error: err.Error()}
+			// an enforced policy fails closed, thus a unit of unknown exposure never goes live
+			if policy.MaxExposure > 0 && policy.Enforce {
+				refuseUnits(logger, app)
+				refused[app.InstID] = true
+				audit.Refused = true
+				report.Fail(app.InstID, err)
+				errs = append(errs, err)
+			}
+
+			report.Update(app.InstID, func(instance *event.InstanceApplied) {
+				instance.Security = audit
+			})
+			continue
+		}
+
+		audit := &event.SecurityAudit{Unit: unit, Exposure: analysis.Exposure, Level: analysis.Level}
+		for _, check := range analysis.Checks {
+			if check.Failed() {
+				audit.FailedChecks = append(audit.FailedChecks, check.Name)
+			}
+		}
+
+		audit.Violation = policy.MaxExposure > 0 && analysis.Exposure > policy.MaxExposure
+		if audit.Violation {
+			err := fmt.Errorf("%s: exposure %.1f exceeds the maximum of %.1f", unit, analysis.Exposure, policy.MaxExposure)
+			logger.Warn("insufficient sandboxing", "unit", unit, "exposure", analysis.Exposure, "max", policy.MaxExposure)
+			if policy.Enforce {
+				refuseUnits(logger, app)
+				refused[app.InstID] = true
+				audit.Refused = true
+				report.Fail(app.InstID, err)
+				errs = append(errs, err)
+			}
+		}
+
+		report.Update(app.InstID, func(instance *event.InstanceApplied) {
+			instance.Security = audit
+		})
+	}
+
+	if err := saveRefusals(refused); err != nil {
+		errs = append(errs, err)
+	}
+
+	return refused, errors.Join(errs...)
+}
+
+// analyzeUnit renders the unit and the declared drop-ins of the application into the given directory and analyzes
+// them offline.
+func analyzeUnit(dir string, app configuration.Application, unit string) (linux.SecurityAnalysis, error) {
+	buf, err := renderUnit(app)
+	if err != nil {
+		return linux.SecurityAnalysis{}, err
+	}
+
+	filename := filepath.Join(dir, unit)
+	if err := linux.WriteFile(filename, buf, 0600); err != nil {
+		return linux.SecurityAnalysis{}, err
+	}
+
+	dropIns, err := dropInFiles(app)
+	if err != nil {
+		return linux.SecurityAnalysis{}, err
+	}
+
+	// a drop-in of a template applies to all of its instances
+	for name, buf := range dropIns {
+		dropIn := filepath.Join(dir, filepath.Base(dropInDir(app)), filepath.Base(name))
+		if err := linux.WriteFile(dropIn, buf, 0600); err != nil {
+			return linux.SecurityAnalysis{}, err
+		}
+	}
+
+	return linux.AnalyzeUnitFile(filename)
+}
+
+// auditedUnit returns the name of the unit, which runs the instance. The slots and replicas share the same
+// sandbox, thus the first one represents all of them.
+func auditedUnit(app configuration.Application) string {
+	switch {
+	case usesReplicas(app):
+		return replicaUnit(app.InstID, 1) + ".service"
+	case usesBlueGreen(app):
+		return slotUnit(app.InstID, slotBlue) + ".service"
+	default:
+		return app.InstID + ".service"
+	}
+}
+
+// refuseUnits stops and disables all units of the instance, so that a weakly sandboxed instance never serves.
+func refuseUnits(logger *slog.Logger, app configuration.Application) {
+	units, err := instanceUnits(app)
+	if err != nil {
+		logger.Warn("cannot list units of instance, refusing main unit only", "instance", app.InstID, "err", err.Error())
+		units = []string{app.InstID + ".service"}
+	}
+
+	for _, u := range units {
+		logger.Warn("refusing unit", "unit", u)
+		if err := run.Command("systemctl", "disable", "--now", u); err != nil {
+			slog.Warn("failed to disable unit, ignoring", "unit", u)
+		}
+	}
+}
+
+// loadRefusals returns the instances, which have been refused by the last apply. Such an instance is stopped on
+// purpose and must not be started again by a repair.
+func loadRefusals() (map[string]bool, error) {
+	res := map[string]bool{}
+	buf, err := os.ReadFile(refusalsFile)
+	if os.IsNotExist(err) {
+		return res, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot read refusals: %w", err)
+	}
+
+	if err := json.Unmarshal(buf, &res); err != nil {
+		return nil, fmt.Errorf("cannot parse refusals: %s: %w", refusalsFile, err)
+	}
+
+	return res, nil
+}
+
+func saveRefusals(refused map[string]bool) error {
+	buf, err := json.Marshal(refused)
+	if err != nil {
+		return err
+	}
+
+	if err := linux.WriteFile(refusalsFile, buf, 0600); err != nil {
+		return fmt.Errorf("cannot write refusals: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,353 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package systemd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/worldiety/nago-runner/configuration"
+	"github.com/worldiety/nago-runner/pkg/linux"
+	"github.com/worldiety/nago-runner/setup"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The blob cache stores every downloaded executable or artifact exactly once, named by its hash:
+//
+//	/var/cache/ngr/blobs/<sha3>   the verified file content
+//	/var/cache/ngr/index.json     the hash index and the last usage of each blob
+//
+// Instances get a hard link to the blob, so that the same build is neither downloaded nor stored twice.
+const (
+	cacheDir               = "/var/cache/ngr"
+	defaultCacheRetention  = 7 * 24 * time.Hour
+	blobsDirName           = "blobs"
+	hashIndexFileName      = "index.json"
+	blobTmpSuffix          = ".tmp"
+	staleBlobTmpFileMaxAge = time.Hour
+)
+
+// hashIndex avoids hashing unchanged files again. The hashes are keyed by linux.FileID, thus all hard links of a
+// blob share the same entry.
+type hashIndex struct {
+	Files map[string]hashIndexEntry `json:"files,omitempty"`
+	// Used is the last time a blob has been referenced by any instance.
+	Used map[configuration.Sha3V512]time.Time `json:"used,omitempty"`
+}
+
+type hashIndexEntry struct {
+	// Filename is the path, through which the file has been hashed. It is only used to prune the index.
+	Filename string                 `json:"filename"`
+	Hash     configuration.Sha3V512 `json:"hash"`
+}
+
+var (
+	hashIndexMutex sync.Mutex
+	// loadedHashIndex is loaded lazily and must only be accessed while holding the hashIndexMutex.
+	loadedHashIndex *hashIndex
+)
+
+// lockedHashIndex returns the loaded index.
+func lockedHashIndex() *hashIndex {
+	if loadedHashIndex == nil {
+		loadedHashIndex = readHashIndex()
+	}
+
+	return loadedHashIndex
+}
+
+// readHashIndex reads the persisted index. A missing or broken index is just an empty cache.
+func readHashIndex() *hashIndex {
+	idx := &hashIndex{}
+	fname := filepath.Join(cacheDir, hashIndexFileName)
+	buf, err := os.ReadFile(fname)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		slog.Error("cannot read hash index, starting empty", "file", fname, "err", err.Error())
+	default:
+		if err := json.Unmarshal(buf, idx); err != nil {
+			slog.Error("cannot parse hash index, starting empty", "file", fname, "err", err.Error())
+			idx = &hashIndex{}
+		}
+	}
+
+	if idx.Files == nil {
+		idx.Files = map[string]hashIndexEntry{}
+	}
+
+	if idx.Used == nil {
+		idx.Used = map[configuration.Sha3V512]time.Time{}
+	}
+
+	return idx
+}
+
+func saveLockedHashIndex() {
+	buf, err := json.Marshal(lockedHashIndex())
+	if err != nil {
+		slog.Error("cannot marshal hash index", "err", err.Error())
+		return
+	}
+
+	if err := linux.WriteFile(filepath.Join(cacheDir, hashIndexFileName), buf, 0600); err != nil {
+		slog.Error("cannot write hash index", "err", err.Error())
+	}
+}
+
+// cachedSha3 behaves like linux.Sha3 but only hashes the file, if its identity has changed since the last call.
+func cachedSha3(file string) (configuration.Sha3V512, error) {
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to stat file: %s: %w", file, err)
+	}
+
+	id, ok := linux.FileID(info)
+	if !ok {
+		return linux.Sha3(file)
+	}
+
+	hashIndexMutex.Lock()
+	defer hashIndexMutex.Unlock()
+
+	idx := lockedHashIndex()
+	if entry, ok := idx.Files[id]; ok {
+		return entry.Hash, nil
+	}
+
+	hash, err := linux.Sha3(file)
+	if err != nil {
+		return "", err
+	}
+
+	idx.Files[id] = hashIndexEntry{Filename: file, Hash: hash}
+	saveLockedHashIndex()
+
+	return hash, nil
+}
+
+// peekSha3 behaves like cachedSha3 but is meant for planning: it neither takes the hashIndexMutex nor writes the
+// index. The persisted index is only read and a file, which is not indexed yet, is hashed without remembering it.
+func peekSha3(file string) (configuration.Sha3V512, error) {
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to stat file: %s: %w", file, err)
+	}
+
+	if id, ok := linux.FileID(info); ok {
+		if entry, ok := readHashIndex().Files[id]; ok {
+			return entry.Hash, nil
+		}
+	}
+
+	return linux.Sha3(file)
+}
+
+// rememberHash puts the already verified hash of the given file into the index.
+func rememberHash(file string, hash configuration.Sha3V512) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return
+	}
+
+	id, ok := linux.FileID(info)
+	if !ok {
+		return
+	}
+
+	hashIndexMutex.Lock()
+	defer hashIndexMutex.Unlock()
+
+	lockedHashIndex().Files[id] = hashIndexEntry{Filename: file, Hash: hash}
+	saveLockedHashIndex()
+}
+
+// touchBlob marks the blob as referenced right now.
+func touchBlob(hash configuration.Sha3V512) {
+	hashIndexMutex.Lock()
+	defer hashIndexMutex.Unlock()
+
+	lockedHashIndex().Used[hash] = time.Now()
+	saveLockedHashIndex()
+}
+
+// fetchBlob returns the path of the cached blob with the given hash. It is only downloaded, if it is not already
+// cached or if the cached file is damaged.
+func fetchBlob(logger *slog.Logger, settings setup.Settings, url configuration.URL, size int64, hash configuration.Sha3V512) (string, error) {
+	if !hash.Valid() {
+		return "", fmt.Errorf("invalid sha3 hash: %q", hash)
+	}
+
+	blob := filepath.Join(cacheDir, blobsDirName, string(hash))
+	if info, err := os.Stat(blob); err == nil {
+		actual, err := cachedSha3(blob)
+		if err == nil && info.Size() == size && actual == hash {
+			logger.Info("using cached blob", "hash", hash)
+			touchBlob(hash)
+			return blob, nil
+		}
+
+		logger.Warn("cached blob is damaged, downloading again", "hash", hash)
+	}
+
+	tmpFile := blob + blobTmpSuffix
+	if err := download(settings, url, tmpFile, size, hash); err != nil {
+		_ = os.Remove(tmpFile)
+		return "", err
+	}
+
+	if err := os.Rename(tmpFile, blob); err != nil {
+		_ = os.Remove(tmpFile)
+		return "", fmt.Errorf("cannot commit blob: %s: %w", blob, err)
+	}
+
+	rememberHash(blob, hash)
+	touchBlob(hash)
+
+	return blob, nil
+}
+
+// installBlob creates dst as a hard link to the blob. The mode belongs to the shared inode, thus if the blob is
+// already linked with a different mode or if dst is located on another filesystem, the blob is copied instead.
+// Copying between files lets the kernel clone the extents (reflink), if the filesystem supports it.
+func installBlob(blob, dst string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("cannot create parent directory: %s: %w", dst, err)
+	}
+
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove file: %s: %w", dst, err)
+	}
+
+	info, err := os.Stat(blob)
+	if err != nil {
+		return fmt.Errorf("cannot stat blob: %s: %w", blob, err)
+	}
+
+	if info.Mode().Perm() == mode || linux.LinkCount(info) == 1 {
+		if err := os.Chmod(blob, mode); err != nil {
+			return fmt.Errorf("cannot chmod blob: %s: %w", blob, err)
+		}
+
+		if err := os.Link(blob, dst); err == nil {
+			return nil
+		}
+	}
+
+	if err := copyFile(blob, dst); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(dst, mode); err != nil {
+		return fmt.Errorf("cannot chmod file: %s: %w", dst, err)
+	}
+
+	rememberHash(dst, configuration.Sha3V512(filepath.Base(blob)))
+
+	return nil
+}
+
+// collectBlobs removes all blobs, which have neither been declared nor been linked by any instance within the
+// retention period of the cache. Index entries of vanished files are dropped as well.
+func collectBlobs(logger *slog.Logger, cfg configuration.Runner) error {
+	retention := cfg.Cache.Retention
+	if retention <= 0 {
+		retention = defaultCacheRetention
+	}
+
+	declared := map[configuration.Sha3V512]bool{}
+	for _, app := range cfg.Applications {
+		declared[app.Executable.Hash] = true
+		for _, file := range app.Artifacts.FileSet.Files {
+			declared[file.Hash] = true
+		}
+	}
+
+	dir := filepath.Join(cacheDir, blobsDirName)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("cannot read blob cache: %w", err)
+	}
+
+	hashIndexMutex.Lock()
+	defer hashIndexMutex.Unlock()
+
+	idx := lockedHashIndex()
+	now := time.Now()
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		fname := filepath.Join(dir, entry.Name())
+
+		// left over by an interrupted download
+		if strings.HasSuffix(entry.Name(), blobTmpSuffix) {
+			if now.Sub(info.ModTime()) > staleBlobTmpFileMaxAge {
+				_ = os.Remove(fname)
+			}
+
+			continue
+		}
+
+		hash := configuration.Sha3V512(entry.Name())
+		if declared[hash] || linux.LinkCount(info) > 1 {
+			idx.Used[hash] = now
+			continue
+		}
+
+		lastUsed, ok := idx.Used[hash]
+		if !ok {
+			lastUsed = info.ModTime()
+		}
+
+		if now.Sub(lastUsed) < retention {
+			continue
+		}
+
+		logger.Info("removing unreferenced blob", "hash", hash, "lastUsed", lastUsed)
+		if err := os.Remove(fname); err != nil {
+			return fmt.Errorf("cannot remove blob: %s: %w", fname, err)
+		}
+
+		delete(idx.Used, hash)
+	}
+
+	for id, entry := range idx.Files {
+		info, err := os.Stat(entry.Filename)
+		if err != nil {
+			delete(idx.Files, id)
+			continue
+		}
+
+		if actual, ok := linux.FileID(info); !ok || actual != id {
+			delete(idx.Files, id)
+		}
+	}
+
+	saveLockedHashIndex()
+
+	return nil
+}
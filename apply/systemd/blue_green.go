@@ -0,0 +1,276 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package systemd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/worldiety/nago-runner/apply"
+	"github.com/worldiety/nago-runner/apply/health"
+	"github.com/worldiety/nago-runner/configuration"
+	"github.com/worldiety/nago-runner/pkg/linux"
+	"github.com/worldiety/nago-runner/pkg/run"
+	"github.com/worldiety/nago-runner/service/event"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	// slotsDir contains the environment files of the slots of each instance
+	slotsDir = "/etc/ngr/slots"
+
+	slotBlue  = "blue"
+	slotGreen = "green"
+
+	defaultPortEnv      = "PORT"
+	defaultReadyTimeout = 60 * time.Second
+	defaultDrain        = 10 * time.Second
+)
+
+// ProxySwitch re-renders and reloads the reverse proxy after the persisted upstreams have changed.
+type ProxySwitch func() error
+
+func usesBlueGreen(app configuration.Application) bool {
+	return app.Deployment.Strategy == configuration.StrategyBlueGreen
+}
+
+// unitName returns the name of the unit file of the application without the .service suffix.
+func unitName(app configuration.Application) string {
+	if usesBlueGreen(app) || usesReplicas(app) {
+		return app.InstID + "@"
+	}
+
+	return app.InstID
+}
+
+func slotPort(app configuration.Application, slot string) int {
+	if slot == slotGreen {
+		return app.Deployment.BlueGreen.GreenPort
+	}
+
+	return app.Deployment.BlueGreen.BluePort
+}
+
+func slotEnvFile(instID, slot string) string {
+	return filepath.Join(slotsDir, instID, slot+".env")
+}
+
+// slotUnit returns the unit name of a slot like my-app@blue.
+func slotUnit(instID, slot string) string {
+	return instID + "@" + slot
+}
+
+// activeSlot returns the slot which currently receives the traffic or the empty string, if none does.
+func activeSlot(app configuration.Application, upstreams apply.Upstreams) string {
+	ports := upstreams[app.InstID]
+	if len(ports) != 1 {
+		return ""
+	}
+
+	switch ports[0] {
+	case app.Deployment.BlueGreen.BluePort:
+		return slotBlue
+	case app.Deployment.BlueGreen.GreenPort:
+		return slotGreen
+	default:
+		return ""
+	}
+}
+
+// slotUnitConfiguration adds the slot environment file to the declared unit, which tells each instance of the
+// template its port.
+func slotUnitConfiguration(app configuration.Application, unit configuration.ServiceUnit) configuration.ServiceUnit {
+	if !usesBlueGreen(app) {
+		return unit
+	}
+
+	file := filepath.Join(slotsDir, app.InstID, "%i.env")
+	unit.Service.EnvironmentFile = append(append([]string(nil), unit.Service.EnvironmentFile...), file)
+	return unit
+}
+
+func validateBlueGreen(app configuration.Application) error {
+	bg := app.Deployment.BlueGreen
+	if bg.BluePort <= 0 || bg.GreenPort <= 0 || bg.BluePort == bg.GreenPort {
+		return fmt.Errorf("blue/green deployment requires two distinct ports: %d and %d", bg.BluePort, bg.GreenPort)
+	}
+
+	return nil
+}
+
+// updateSlots writes the environment files of both slots and returns true, if any of them has changed.
+func updateSlots(app configuration.Application) (bool, error) {
+	if !usesBlueGreen(app) {
+		return false, nil
+	}
+
+	if err := validateBlueGreen(app); err != nil {
+		return false, err
+	}
+
+	portEnv := app.Deployment.BlueGreen.PortEnv
+	if portEnv == "" {
+		portEnv = defaultPortEnv
+	}
+
+	changed := false
+	for _, slot := range []string{slotBlue, slotGreen} {
+		file := slotEnvFile(app.InstID, slot)
+		buf := []byte(portEnv + "=" + strconv.Itoa(slotPort(app, slot)) + "\n")
+		if linux.EqualBuf(file, buf) {
+			continue
+		}
+
+		if err := linux.WriteFile(file, buf, 0644); err != nil {
+			return false, fmt.Errorf("cannot write slot environment: %w", err)
+		}
+
+		changed = true
+	}
+
+	return changed, nil
+}
+
+// deployBlueGreen starts the changed instance in the inactive slot and switches the proxy to it, as soon as it is
+// ready. The formerly active slot is stopped after draining. If the new slot does not become ready, it is stopped
+// again and the previous version is put back, so the traffic never leaves the active slot.
+func deployBlueGreen(logger *slog.Logger, bus event.Bus, d deployment, upstreams apply.Upstreams, switchProxy ProxySwitch, report *apply.Report) error {
+	app := d.app
+	bg := app.Deployment.BlueGreen
+	active := activeSlot(app, upstreams)
+	target := slotBlue
+	if active == slotBlue {
+		target = slotGreen
+	}
+
+	unit := slotUnit(app.InstID, target)
+	logger.Info("starting new slot", "instance", app.InstID, "slot", target, "active", active)
+	if err := run.Command("systemctl", "restart", unit); err != nil {
+		logger.Warn("failed to start slot", "unit", unit, "err", err.Error())
+	}
+
+	report.Restarted(app.InstID, unit)
+
+	if err := waitSlotReady(logger, app, target); err != nil {
+		logger.Error("new slot did not become ready", "unit", unit, "err", err.Error())
+		if err := run.Command("systemctl", "stop", unit); err != nil {
+			logger.Warn("failed to stop slot", "unit", unit)
+		}
+
+		// the active slot must not pick up the broken version, when it gets restarted later
+		if rollbackDeployment(logger, bus, d, err, report) {
+			if rerr := run.Command("systemctl", "daemon-reload"); rerr != nil {
+				logger.Error("error reloading systemd daemon after rollback", "err", rerr.Error())
+			}
+		}
+
+		return fmt.Errorf("slot %s did not become ready: %w", unit, err)
+	}
+
+	upstreams[app.InstID] = []int{slotPort(app, target)}
+	if err := upstreams.Save(); err != nil {
+		return err
+	}
+
+	if err := switchProxy(); err != nil {
+		return fmt.Errorf("cannot switch proxy to slot %s: %w", unit, err)
+	}
+
+	if err := run.Command("systemctl", "enable", unit); err != nil {
+		logger.Warn("failed to enable slot", "unit", unit)
+	}
+
+	if active == "" {
+		return nil
+	}
+
+	drain := bg.Drain
+	if drain == 0 {
+		drain = defaultDrain
+	}
+
+	old := slotUnit(app.InstID, active)
+	logger.Info("draining former slot", "unit", old, "drain", drain)
+	time.Sleep(drain)
+	if err := run.Command("systemctl", "disable", "--now", old); err != nil {
+		logger.Warn("failed to stop former slot", "unit", old)
+	}
+
+	return nil
+}
+
+// waitSlotReady polls the slot until its port serves requests or the timeout exceeds.
+func waitSlotReady(logger *slog.Logger, app configuration.Application, slot string) error {
+	bg := app.Deployment.BlueGreen
+	return waitReady(logger, slotUnit(app.InstID, slot), slotPort(app, slot), bg.ReadinessPath, bg.Timeout)
+}
+
+// waitReady polls the unit until the local port serves requests or the timeout exceeds. Without a readiness
+// path, the port must just accept tcp connections.
+func waitReady(logger *slog.Logger, unit string, port int, readinessPath string, timeout time.Duration) error {
+	if timeout == 0 {
+		timeout = defaultReadyTimeout
+	}
+
+	addr := "127.0.0.1:" + strconv.Itoa(port)
+	probe := configuration.Probe{TCP: addr}
+	if readinessPath != "" {
+		probe = configuration.Probe{HTTP: configuration.URL("http://" + addr + readinessPath)}
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+
+		props, err := linux.ServiceProperties(unit, "ActiveState")
+		if err != nil {
+			return err
+		}
+
+		if props["ActiveState"] == "failed" {
+			if err := hookFailure(unit); err != nil {
+				return err
+			}
+
+			return errors.New("unit has failed")
+		}
+
+		err = health.Probe(context.Background(), probe)
+		if err == nil {
+			return nil
+		}
+
+		logger.Info("unit not yet ready", "unit", unit, "err", err.Error())
+	}
+
+	return fmt.Errorf("not ready within %s", timeout)
+}
+
+// removeSlots disables all slots or replicas of the instance and removes their environment files and drop-ins.
+func removeSlots(instID string) error {
+	links, err := filepath.Glob(filepath.Join(systemdConfDir, "*.wants", instID+"@*.service"))
+	if err != nil {
+		return err
+	}
+
+	for _, link := range links {
+		if err := os.Remove(link); err != nil {
+			return fmt.Errorf("cannot disable slot: %w", err)
+		}
+	}
+
+	if err := removeReplicaDropIns(instID, 0); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(filepath.Join(slotsDir, instID))
+}
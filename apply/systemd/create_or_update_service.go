@@ -9,31 +9,159 @@ package systemd
 
 import (
 	"fmt"
+	"github.com/worldiety/nago-runner/apply"
 	"github.com/worldiety/nago-runner/configuration"
+	"github.com/worldiety/nago-runner/service/event"
 	"github.com/worldiety/nago-runner/setup"
 	"log/slog"
 	"path/filepath"
 )
 
-func createOrUpdateService(logger *slog.Logger, settings setup.Settings, cfg configuration.Application) (Service, bool, error) {
-	execUpdated, err := updateExecutable(logger, settings, cfg)
+// serviceChanges tells which parts of a service have been updated.
+type serviceChanges struct {
+	Executable bool
+	Unit       bool
+	DropIns    bool
+	Restore    bool
+	// Credentials are only read by systemd when the service starts.
+	Credentials bool
+	// Socket is only read by systemd when the socket starts.
+	Socket bool
+	// Resurrected instances have been stopped as a tombstone and need to be started again.
+	Resurrected bool
+	// Timers of changed jobs, which need to be restarted but do not affect the running service.
+	Timers []string
+}
+
+// Any returns true, if the service requires a restart.
+func (c serviceChanges) Any() bool {
+	return c.Executable || c.Unit || c.DropIns || c.Restore || c.Credentials || c.Socket || c.Resurrected
+}
+
+// deployment is a service which has been changed and needs to be restarted.
+type deployment struct {
+	app     configuration.Application
+	service Service
+	changes serviceChanges
+}
+
+// createOrUpdateService brings all files of the application up to date. Each part is recorded as a step of the
+// instance in the report.
+func createOrUpdateService(logger *slog.Logger, settings setup.Settings, bus event.Bus, cfg configuration.Application, report *apply.Report) (Service, serviceChanges, error) {
+	var changes serviceChanges
+	err := report.Step(cfg.InstID, "executable", func() error {
+		var err error
+		switch {
+		case cfg.Build.Enabled:
+			changes.Executable, err = buildExecutable(logger, bus, cfg)
+		case usesArtifacts(cfg):
+			changes.Executable, err = updateArtifacts(logger, settings, cfg)
+		default:
+			changes.Executable, err = updateExecutable(logger, settings, cfg)
+		}
+
+		return err
+	})
+
+	if err != nil {
+		return Service{}, changes, fmt.Errorf("failed to update executable: %w", err)
+	}
+
+	err = report.Step(cfg.InstID, "credentials", func() error {
+		var err error
+		changes.Credentials, err = updateCredentials(logger, cfg)
+		return err
+	})
+
+	if err != nil {
+		return Service{}, changes, fmt.Errorf("failed to update credentials: %w", err)
+	}
+
+	err = report.Step(cfg.InstID, "unit", func() error {
+		unitUpdated, err := updateSystemd(logger, settings, cfg)
+		if err != nil {
+			return fmt.Errorf("failed to update systemd unit: %w", err)
+		}
+
+		slotsUpdated, err := updateSlots(cfg)
+		if err != nil {
+			return fmt.Errorf("failed to update slots: %w", err)
+		}
+
+		replicasUpdated, err := updateReplicas(logger, cfg)
+		if err != nil {
+			return fmt.Errorf("failed to update replicas: %w", err)
+		}
+
+		changes.Unit = unitUpdated || slotsUpdated || replicasUpdated
+		return nil
+	})
+
 	if err != nil {
-		return Service{}, false, fmt.Errorf("failed to update executable: %w", err)
+		return Service{}, changes, err
 	}
 
-	unitUpdated, err := updateSystemd(logger, settings, cfg)
+	err = report.Step(cfg.InstID, "dropIns", func() error {
+		var err error
+		changes.DropIns, err = updateDropIns(logger, cfg)
+		return err
+	})
+
 	if err != nil {
-		return Service{}, false, fmt.Errorf("failed to update systemd unit: %w", err)
+		return Service{}, changes, fmt.Errorf("failed to update drop-ins: %w", err)
 	}
 
-	service, err := ParseService(logger, filepath.Join(systemdConfDir, string(cfg.InstID)+".service"))
+	err = report.Step(cfg.InstID, "socket", func() error {
+		var err error
+		changes.Socket, err = updateSocket(logger, cfg)
+		return err
+	})
+
 	if err != nil {
-		return Service{}, false, fmt.Errorf("cannot parse systemd conf file: %s: %w", cfg.InstID, err)
+		return Service{}, changes, fmt.Errorf("failed to update socket: %w", err)
 	}
 
-	if !unitUpdated && !execUpdated {
-		return service, false, nil
+	err = report.Step(cfg.InstID, "jobs", func() error {
+		var err error
+		changes.Timers, err = updateJobs(logger, cfg)
+		return err
+	})
+
+	if err != nil {
+		return Service{}, changes, fmt.Errorf("failed to update jobs: %w", err)
+	}
+
+	err = report.Step(cfg.InstID, "restore", func() error {
+		var err error
+		changes.Restore, err = updateRestore(logger, settings, cfg)
+		return err
+	})
+
+	if err != nil {
+		return Service{}, changes, fmt.Errorf("failed to restore data: %w", err)
+	}
+
+	// only a complete instance leaves its tombstone, otherwise the next apply would not start it
+	changes.Resurrected, err = resurrect(logger, cfg.InstID)
+	if err != nil {
+		return Service{}, changes, err
+	}
+
+	report.Update(cfg.InstID, func(instance *event.InstanceApplied) {
+		instance.Changes.Executable = changes.Executable
+		instance.Changes.Unit = changes.Unit
+		instance.Changes.DropIns = changes.DropIns
+		instance.Changes.Credentials = changes.Credentials
+		instance.Changes.Socket = changes.Socket
+		instance.Changes.Restore = changes.Restore
+		instance.Changes.Resurrected = changes.Resurrected
+		instance.Changes.Timers = changes.Timers
+	})
+
+	service, err := ParseService(logger, filepath.Join(systemdConfDir, unitName(cfg)+".service"))
+	if err != nil {
+		return Service{}, changes, fmt.Errorf("cannot parse systemd conf file: %s: %w", cfg.InstID, err)
 	}
 
-	return service, true, nil
+	return service, changes, nil
 }
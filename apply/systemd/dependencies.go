@@ -0,0 +1,104 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package systemd
+
+import (
+	"errors"
+	"github.com/worldiety/nago-runner/configuration"
+	"slices"
+)
+
+// resolveDependencies returns the applications in topological order, thus every instance comes after its
+// dependencies. Otherwise, the declared order is kept. The dependencies have already been checked by
+// configuration.Runner.Validate. They are added to the unit declaration of each returned application, so that
+// they are rendered into its unit files like any other declared value.
+func resolveDependencies(cfg configuration.Runner) ([]configuration.Application, error) {
+	apps := map[string]configuration.Application{}
+	for _, app := range cfg.Applications {
+		apps[app.InstID] = app
+	}
+
+	emitted := map[string]bool{}
+	ready := func(app configuration.Application) bool {
+		for _, dep := range app.Dependencies {
+			if !emitted[dep.InstID] {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	res := make([]configuration.Application, 0, len(cfg.Applications))
+	done := map[int]bool{}
+	for len(res) < len(cfg.Applications) {
+		progress := false
+		for i, app := range cfg.Applications {
+			if done[i] || !ready(app) {
+				continue
+			}
+
+			done[i] = true
+			emitted[app.InstID] = true
+			res = append(res, dependencyUnitConfiguration(apps, app))
+			progress = true
+			break
+		}
+
+		if !progress {
+			return nil, errors.New("cannot order applications by their dependencies")
+		}
+	}
+
+	return res, nil
+}
+
+// dependencyUnits returns the units, which run the given instance.
+func dependencyUnits(target configuration.Application) []configuration.Name {
+	switch {
+	case usesSocket(target):
+		return []configuration.Name{configuration.Name(target.InstID + ".socket")}
+	case usesReplicas(target):
+		var res []configuration.Name
+		for i := 1; i <= target.Replicas.Count; i++ {
+			res = append(res, configuration.Name(replicaUnit(target.InstID, i)+".service"))
+		}
+
+		return res
+	default:
+		return []configuration.Name{configuration.Name(target.InstID + ".service")}
+	}
+}
+
+// dependencyUnitConfiguration adds the units of all dependencies to the declared unit of the application. Every
+// kind of dependency also orders the start.
+func dependencyUnitConfiguration(apps map[string]configuration.Application, app configuration.Application) configuration.Application {
+	if len(app.Dependencies) == 0 {
+		return app
+	}
+
+	unit := &app.Sandbox.Unit.Unit
+	unit.AfterUnits = slices.Clone(unit.AfterUnits)
+	unit.Requires = slices.Clone(unit.Requires)
+	unit.Wants = slices.Clone(unit.Wants)
+	unit.BindsTo = slices.Clone(unit.BindsTo)
+	for _, dep := range app.Dependencies {
+		units := dependencyUnits(apps[dep.InstID])
+		unit.AfterUnits = append(unit.AfterUnits, units...)
+		switch dep.Kind {
+		case "", configuration.DependencyRequires:
+			unit.Requires = append(unit.Requires, units...)
+		case configuration.DependencyWants:
+			unit.Wants = append(unit.Wants, units...)
+		case configuration.DependencyBindsTo:
+			unit.BindsTo = append(unit.BindsTo, units...)
+		}
+	}
+
+	return app
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package systemd
+
+import (
+	"github.com/worldiety/nago-runner/configuration"
+	"slices"
+	"testing"
+)
+
+func TestResolveDependencies(t *testing.T) {
+	app := func(id string, deps ...string) configuration.Application {
+		a := configuration.Application{InstID: id}
+		for _, dep := range deps {
+			a.Dependencies = append(a.Dependencies, configuration.Dependency{InstID: dep})
+		}
+
+		return a
+	}
+
+	tests := []struct {
+		name    string
+		apps    []configuration.Application
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "declared order without dependencies",
+			apps: []configuration.Application{app("a"), app("b"), app("c")},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "dependency first",
+			apps: []configuration.Application{app("web", "db"), app("db")},
+			want: []string{"db", "web"},
+		},
+		{
+			name: "chain",
+			apps: []configuration.Application{app("a", "b"), app("b", "c"), app("c")},
+			want: []string{"c", "b", "a"},
+		},
+		{
+			name: "diamond keeps declared order",
+			apps: []configuration.Application{app("top", "left", "right"), app("left", "base"), app("right", "base"), app("base")},
+			want: []string{"base", "left", "right", "top"},
+		},
+		{
+			name:    "cycle",
+			apps:    []configuration.Application{app("a", "b"), app("b", "a")},
+			wantErr: true,
+		},
+		{
+			name:    "undeclared dependency",
+			apps:    []configuration.Application{app("a", "missing")},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := resolveDependencies(configuration.Runner{Applications: tt.apps})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", res)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, a := range res {
+				got = append(got, a.InstID)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveDependenciesUnits(t *testing.T) {
+	db := configuration.Application{InstID: "db"}
+	web := configuration.Application{InstID: "web", Dependencies: []configuration.Dependency{
+		{InstID: "db", Kind: configuration.DependencyWants},
+	}}
+
+	res, err := resolveDependencies(configuration.Runner{Applications: []configuration.Application{web, db}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unit := res[1].Sandbox.Unit.Unit
+	want := []configuration.Name{"db.service"}
+	if !slices.Equal(unit.AfterUnits, want) || !slices.Equal(unit.Wants, want) || len(unit.Requires) != 0 {
+		t.Fatalf("unexpected units: %+v", unit)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package systemd
+
+import (
+	"fmt"
+	"github.com/worldiety/nago-runner/configuration"
+	"github.com/worldiety/nago-runner/pkg/linux"
+	"github.com/worldiety/nago-runner/setup"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// download fetches the given url into the dst file and verifies the expected size and hash. A relative url is
+// resolved against the hub. On failure, the dst file may contain partial data.
+func download(settings setup.Settings, url configuration.URL, dst string, size int64, hash configuration.Sha3V512) error {
+	uri := string(url)
+	if !strings.HasPrefix(uri, "http") {
+		uri = settings.Endpoints().Http(uri)
+	}
+
+	client := &http.Client{
+		Timeout: 60 * time.Second,
+	}
+
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return fmt.Errorf("error creating http request: %s", uri)
+	}
+
+	// send our bearer secret to authorize us properly at the remote side
+	req.Header.Add("Authorization", "Bearer "+settings.Token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error executing http request: %s", uri)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected http response when downloading: %s: %s", resp.Status, uri)
+	}
+
+	if _, err := os.Stat(filepath.Dir(dst)); os.IsNotExist(err) {
+		_ = os.MkdirAll(filepath.Dir(dst), 0755)
+	}
+
+	w, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening tmp file: %s", dst)
+	}
+
+	downloadStart := time.Now()
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		_ = w.Close()
+		return fmt.Errorf("error downloading: %s", uri)
+	}
+
+	slog.Info("downloaded file", "file", dst, "size", n, "took", time.Since(downloadStart))
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("error comitting/closing tmp file: %s", dst)
+	}
+
+	if n != size {
+		return fmt.Errorf("size mismatch: got %d, want %d", n, size)
+	}
+
+	downloadedHash, err := linux.Sha3(dst)
+	if err != nil {
+		return fmt.Errorf("error hashing downloaded file: %s", dst)
+	}
+
+	if downloadedHash != hash {
+		return fmt.Errorf("hash mismatch for download: got %s, want %s", downloadedHash, hash)
+	}
+
+	return nil
+}
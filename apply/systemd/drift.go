@@ -0,0 +1,105 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package systemd
+
+import (
+	"fmt"
+	"github.com/worldiety/nago-runner/apply"
+	"github.com/worldiety/nago-runner/configuration"
+	"github.com/worldiety/nago-runner/pkg/linux"
+	"github.com/worldiety/nago-runner/pkg/run"
+	"github.com/worldiety/nago-runner/service/event"
+	"log/slog"
+	"slices"
+)
+
+// ServiceDrift reports all declared units, which are expected to run but are either not enabled or not active,
+// e.g. because they have been stopped or disabled by hand. Changed files are not detected here, see Plan.
+func ServiceDrift(cfg configuration.Runner) ([]event.ServiceDrift, error) {
+	upstreams, err := apply.LoadUpstreams()
+	if err != nil {
+		return nil, err
+	}
+
+	// refused units have been stopped on purpose
+	refused, err := loadRefusals()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []event.ServiceDrift
+	for _, app := range cfg.Applications {
+		if refused[app.InstID] {
+			continue
+		}
+
+		for _, unit := range runningUnits(app, upstreams) {
+			props, err := linux.ServiceProperties(unit, "ActiveState", "UnitFileState")
+			if err != nil {
+				return nil, fmt.Errorf("cannot inspect unit: %s: %w", unit, err)
+			}
+
+			active := props["ActiveState"]
+			enabled := props["UnitFileState"]
+			if slices.Contains([]string{"active", "activating", "reloading"}, active) && enabled == "enabled" {
+				continue
+			}
+
+			res = append(res, event.ServiceDrift{
+				InstanceID:    app.InstID,
+				Unit:          unit,
+				ActiveState:   active,
+				UnitFileState: enabled,
+			})
+		}
+	}
+
+	return res, nil
+}
+
+// runningUnits returns the units of the application, which must be enabled and active all the time. A socket
+// activated service and the services of jobs are only started on demand, thus their socket or timer is returned
+// instead. A blue/green instance without an active slot has not been deployed yet.
+func runningUnits(app configuration.Application, upstreams apply.Upstreams) []string {
+	var res []string
+	switch {
+	case usesSocket(app):
+		res = append(res, app.InstID+".socket")
+	case usesBlueGreen(app):
+		if slot := activeSlot(app, upstreams); slot != "" {
+			res = append(res, slotUnit(app.InstID, slot))
+		}
+	case usesReplicas(app):
+		for i := 1; i <= app.Replicas.Count; i++ {
+			res = append(res, replicaUnit(app.InstID, i)+".service")
+		}
+	default:
+		res = append(res, app.InstID+".service")
+	}
+
+	for _, job := range app.Jobs {
+		res = append(res, jobUnitName(app, job)+".timer")
+	}
+
+	return res
+}
+
+// StartServices enables and starts the given drifted units again.
+func StartServices(logger *slog.Logger, drift []event.ServiceDrift) {
+	for _, d := range drift {
+		logger.Info("enable unit", "unit", d.Unit)
+		if err := run.Command("systemctl", "enable", d.Unit); err != nil {
+			slog.Warn("failed to enable unit, ignoring", "unit", d.Unit)
+		}
+
+		logger.Info("start unit", "unit", d.Unit)
+		if err := run.Command("systemctl", "start", d.Unit); err != nil {
+			slog.Warn("failed to start unit, ignoring", "unit", d.Unit)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package systemd
+
+import (
+	"fmt"
+	"github.com/worldiety/nago-runner/pkg/linux"
+	"github.com/worldiety/nago-runner/pkg/run"
+	"log/slog"
+)
+
+// hookFailure returns an error describing the first failed ExecStartPre or ExecStartPost command of the unit,
+// e.g. a migration, or nil if all of them have succeeded or the status is unavailable.
+func hookFailure(unit string) error {
+	for _, prop := range []string{"ExecStartPre", "ExecStartPost"} {
+		statuses, err := linux.ExecStatuses(unit, prop)
+		if err != nil {
+			return nil
+		}
+
+		for _, status := range statuses {
+			if status.Failed() {
+				return fmt.Errorf("%s %s failed: %s with status %s", prop, status.Argv, status.Code, status.Status)
+			}
+		}
+	}
+
+	return nil
+}
+
+// restartService restarts the unit and returns an error, if it could not be started. A failed hook is reported
+// instead of the generic error of systemctl, so that e.g. a failed migration becomes visible as such.
+func restartService(logger *slog.Logger, unit string) error {
+	logger.Info("restart service", "service", unit)
+	if err := run.Command("systemctl", "restart", unit); err != nil {
+		slog.Warn("failed to restart service", "service", unit, "err", err.Error())
+		if herr := hookFailure(unit); herr != nil {
+			return herr
+		}
+
+		return fmt.Errorf("failed to restart service: %w", err)
+	}
+
+	return nil
+}
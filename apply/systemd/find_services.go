@@ -12,10 +12,11 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
-	"strings"
+	"slices"
 )
 
-// FindServices inspects all available systemd system service files.
+// FindServices inspects all available systemd system unit files of the types generated by the runner, which
+// are services, timers and sockets.
 func FindServices(logger *slog.Logger) ([]Service, error) {
 	files, err := os.ReadDir(systemdConfDir)
 	if err != nil {
@@ -24,7 +25,7 @@ func FindServices(logger *slog.Logger) ([]Service, error) {
 
 	var units []Service
 	for _, file := range files {
-		if !file.Type().IsRegular() || !strings.HasSuffix(file.Name(), ".service") {
+		if !file.Type().IsRegular() || !slices.Contains(unitSuffixes, filepath.Ext(file.Name())) {
 			continue
 		}
 
@@ -41,4 +42,9 @@ func FindServices(logger *slog.Logger) ([]Service, error) {
 
 const (
 	ngrMetaPrefix = "# ngr-meta: "
+	// ngrJobPrefix marks the units of a job, which belong to the instance of the meta header.
+	ngrJobPrefix = "# ngr-job: "
 )
+
+// unitSuffixes are the types of units, which are generated and therefore managed by the runner.
+var unitSuffixes = []string{".service", ".timer", ".socket"}
@@ -0,0 +1,239 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package systemd
+
+import (
+	"fmt"
+	"github.com/worldiety/nago-runner/configuration"
+	"github.com/worldiety/nago-runner/pkg/diff"
+	"github.com/worldiety/nago-runner/service/event"
+	"log/slog"
+	"maps"
+	"slices"
+)
+
+// Plan calculates the changes which Apply would perform for the given configuration. It is a dry-run and
+// does not modify anything, thus it is safe to call it at any time.
+func Plan(logger *slog.Logger, cfg configuration.Runner) (event.Plan, error) {
+	var plan event.Plan
+
+	apps, err := resolveDependencies(cfg)
+	if err != nil {
+		return plan, fmt.Errorf("invalid dependencies: %w", err)
+	}
+
+	apps = resolveSlices(apps)
+
+	_, removeServices, staleServices, err := categorizeServices(logger, cfg)
+	if err != nil {
+		return plan, fmt.Errorf("cannot categorize services: %w", err)
+	}
+
+	for _, service := range removeServices {
+		// a tombstone has already been stopped and is purged independently of applying
+		isTombstone, err := tombstoned(service.InstanceID())
+		if err != nil {
+			return plan, err
+		}
+
+		if isTombstone {
+			continue
+		}
+
+		paths := service.Paths()
+		plan.Purges = append(plan.Purges, event.PurgeChange{
+			InstanceID:    service.InstanceID(),
+			UnitFilename:  service.UnitFilename,
+			ExecFilename:  paths.ExecFilename,
+			DataDirectory: paths.DataDirectory,
+		})
+	}
+
+	// stale units are removed without touching the executable or the data
+	for _, service := range staleServices {
+		plan.Purges = append(plan.Purges, event.PurgeChange{
+			InstanceID:   service.InstanceID(),
+			UnitFilename: service.UnitFilename,
+		})
+	}
+
+	for _, app := range apps {
+		if !configuration.Name(app.InstID).Valid() {
+			return plan, fmt.Errorf("invalid systemd unit name: %s", app.InstID)
+		}
+
+		// Apply skips a rolled back declaration, until it changes
+		rolledBack, err := rolledBackDeclaration(app)
+		if err != nil {
+			return plan, err
+		}
+
+		if rolledBack != "" {
+			continue
+		}
+
+		service := NewService(unitName(app))
+		paths := service.Paths()
+		hash, err := peekSha3(paths.ExecFilename)
+		if err != nil {
+			return plan, fmt.Errorf("error hashing executable: %s: %w", paths.ExecFilename, err)
+		}
+
+		if app.Build.Enabled {
+			pending, err := buildPending(app)
+			if err != nil {
+				return plan, fmt.Errorf("cannot plan build: %s: %w", app.InstID, err)
+			}
+
+			if pending {
+				// the resulting hash is unknown until the build has been performed
+				plan.Executables = append(plan.Executables, event.ExecutableChange{
+					InstanceID:  app.InstID,
+					Filename:    paths.ExecFilename,
+					URL:         app.Build.Git.URL,
+					CurrentHash: string(hash),
+				})
+			}
+		} else if usesArtifacts(app) {
+			if artifactsPending(app) {
+				plan.Executables = append(plan.Executables, event.ExecutableChange{
+					InstanceID:   app.InstID,
+					Filename:     paths.ExecFilename,
+					URL:          app.Artifacts.FileSet.Name,
+					Size:         app.Artifacts.FileSet.Size(),
+					ExpectedHash: string(app.Artifacts.FileSet.Hash),
+				})
+			}
+		} else if hash != app.Executable.Hash {
+			plan.Executables = append(plan.Executables, event.ExecutableChange{
+				InstanceID:   app.InstID,
+				Filename:     paths.ExecFilename,
+				URL:          string(app.Executable.URL),
+				Size:         app.Executable.Size,
+				CurrentHash:  string(hash),
+				ExpectedHash: string(app.Executable.Hash),
+			})
+		}
+
+		restore, err := restorePending(app)
+		if err != nil {
+			return plan, fmt.Errorf("cannot plan restore: %s: %w", app.InstID, err)
+		}
+
+		if restore {
+			plan.Restores = append(plan.Restores, event.RestoreChange{
+				InstanceID:  app.InstID,
+				FileSetID:   string(app.Restore.FileSet),
+				RemoveExtra: app.Restore.RemoveExtra,
+			})
+		}
+
+		creds, err := credentialsPending(app)
+		if err != nil {
+			return plan, fmt.Errorf("cannot plan credentials: %s: %w", app.InstID, err)
+		}
+
+		for _, name := range creds {
+			plan.Credentials = append(plan.Credentials, event.CredentialChange{InstanceID: app.InstID, Name: name})
+		}
+
+		expected, err := renderUnit(app)
+		if err != nil {
+			return plan, fmt.Errorf("cannot render unit: %s: %w", app.InstID, err)
+		}
+
+		change, err := planFile(service.UnitFilename, expected)
+		if err != nil {
+			return plan, err
+		}
+
+		if change.Diff != "" {
+			plan.Files = append(plan.Files, change)
+		}
+
+		files, err := jobFiles(app)
+		if err != nil {
+			return plan, fmt.Errorf("cannot render jobs: %s: %w", app.InstID, err)
+		}
+
+		if usesSocket(app) {
+			buf, err := renderSocket(app)
+			if err != nil {
+				return plan, err
+			}
+
+			files[socketFilename(app)] = buf
+		}
+
+		dropIns, err := dropInFiles(app)
+		if err != nil {
+			return plan, fmt.Errorf("cannot render drop-ins: %s: %w", app.InstID, err)
+		}
+
+		undeclared, err := undeclaredDropIns(app, dropIns)
+		if err != nil {
+			return plan, err
+		}
+
+		maps.Copy(files, dropIns)
+		for _, filename := range undeclared {
+			// an empty file plans the removal
+			files[filename] = nil
+		}
+
+		for _, filename := range slices.Sorted(maps.Keys(files)) {
+			change, err := planFile(filename, files[filename])
+			if err != nil {
+				return plan, err
+			}
+
+			if change.Diff != "" {
+				plan.Files = append(plan.Files, change)
+			}
+		}
+	}
+
+	sliceUnits, err := sliceFiles(cfg)
+	if err != nil {
+		return plan, fmt.Errorf("cannot render slices: %w", err)
+	}
+
+	undeclared, err := undeclaredSlices(sliceUnits)
+	if err != nil {
+		return plan, err
+	}
+
+	for _, filename := range undeclared {
+		// an empty file plans the removal
+		sliceUnits[filename] = nil
+	}
+
+	for _, filename := range slices.Sorted(maps.Keys(sliceUnits)) {
+		change, err := planFile(filename, sliceUnits[filename])
+		if err != nil {
+			return plan, err
+		}
+
+		if change.Diff != "" {
+			plan.Files = append(plan.Files, change)
+		}
+	}
+
+	return plan, nil
+}
+
+// planFile compares the current file content with the expected content. The returned diff is empty, if
+// nothing would change.
+func planFile(filename string, expected []byte) (event.FileChange, error) {
+	d, err := diff.File(filename, expected)
+	if err != nil {
+		return event.FileChange{}, err
+	}
+
+	return event.FileChange{Filename: filename, Diff: d}, nil
+}
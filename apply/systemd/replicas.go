@@ -0,0 +1,330 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package systemd
+
+import (
+	"fmt"
+	"github.com/worldiety/nago-runner/apply"
+	"github.com/worldiety/nago-runner/configuration"
+	"github.com/worldiety/nago-runner/pkg/linux"
+	"github.com/worldiety/nago-runner/pkg/run"
+	"github.com/worldiety/nago-runner/service/event"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// replicaDropInName is the drop-in of each replica, which tells it its port and its state directory. In contrast
+// to the environment files of the slots, a drop-in can also replace the StateDirectory of the template.
+const replicaDropInName = "ngr-replica.conf"
+
+func usesReplicas(app configuration.Application) bool {
+	return app.Replicas.Count > 0
+}
+
+// replicaUnit returns the unit name of a replica like my-app@1.
+func replicaUnit(instID string, replica int) string {
+	return instID + "@" + strconv.Itoa(replica)
+}
+
+func replicaPort(app configuration.Application, replica int) int {
+	return app.Replicas.BasePort + replica - 1
+}
+
+// replicaPorts returns the ports of all declared replicas in ascending order.
+func replicaPorts(app configuration.Application) []int {
+	var res []int
+	for i := 1; i <= app.Replicas.Count; i++ {
+		res = append(res, replicaPort(app, i))
+	}
+
+	return res
+}
+
+func replicaDropInDir(instID string, replica int) string {
+	return filepath.Join(systemdConfDir, replicaUnit(instID, replica)+".service.d")
+}
+
+// replicasServing returns true, if the proxy balances exactly across all declared replicas.
+func replicasServing(app configuration.Application, upstreams apply.Upstreams) bool {
+	return slices.Equal(upstreams[app.InstID], replicaPorts(app))
+}
+
+// renderReplicaDropIn generates the drop-in of the given replica.
+func renderReplicaDropIn(app configuration.Application, replica int) ([]byte, error) {
+	portEnv := app.Replicas.PortEnv
+	if portEnv == "" {
+		portEnv = defaultPortEnv
+	}
+
+	var w unitWriter
+	w.comment(`Code generated by "nago-runner"; DO NOT EDIT.`)
+	w.section("Service")
+	w.env("Environment", []configuration.EnvVar{
+		{Key: portEnv, Value: strconv.Itoa(replicaPort(app, replica))},
+		{Key: "REPLICA", Value: strconv.Itoa(replica)},
+	})
+
+	if dir := app.Sandbox.Unit.Service.StateDirectory; dir != "" {
+		// a drop-in appends to the list of the template, thus reset it before declaring the directories of the replica
+		var dirs []string
+		for _, d := range strings.Fields(dir) {
+			dirs = append(dirs, filepath.Join(d, strconv.Itoa(replica)))
+		}
+
+		w.reset("StateDirectory")
+		w.text("StateDirectory", strings.Join(dirs, " "))
+	}
+
+	buf, err := w.bytes()
+	if err != nil {
+		return nil, fmt.Errorf("cannot render replica %d of %s: %w", replica, app.InstID, err)
+	}
+
+	return buf, nil
+}
+
+// updateReplicas writes the drop-ins of all declared replicas and returns true, if the drop-in of an existing
+// replica has changed. Additional replicas do not require the existing ones to be restarted. If the instance does
+// not use replicas (anymore), all former replicas are stopped.
+func updateReplicas(logger *slog.Logger, app configuration.Application) (bool, error) {
+	if !usesReplicas(app) {
+		return false, stopReplicas(logger, app.InstID, 0)
+	}
+
+	changed := false
+	for i := 1; i <= app.Replicas.Count; i++ {
+		buf, err := renderReplicaDropIn(app, i)
+		if err != nil {
+			return false, err
+		}
+
+		file := filepath.Join(replicaDropInDir(app.InstID, i), replicaDropInName)
+		if linux.EqualBuf(file, buf) {
+			continue
+		}
+
+		_, err = os.Stat(file)
+		existed := err == nil
+		if err := linux.WriteFile(file, buf, 0644); err != nil {
+			return false, fmt.Errorf("cannot write replica drop-in: %w", err)
+		}
+
+		changed = changed || existed
+	}
+
+	return changed, nil
+}
+
+// deployReplicas brings the replicas of the instance up to the declared count and version. Changed replicas are
+// restarted one after another and each one is taken out of the proxy until it is ready again, thus the others keep
+// serving. Additional replicas are added to the proxy as soon as they are ready, surplus replicas are taken out of
+// the proxy, drained and stopped. If a replica does not become ready, the rollout stops and the previous version is
+// put back, thus the replicas which have already been restarted return to it and the others never pick up the
+// broken one.
+func deployReplicas(logger *slog.Logger, bus event.Bus, d deployment, upstreams apply.Upstreams, switchProxy ProxySwitch, report *apply.Report) error {
+	app := d.app
+	r := app.Replicas
+	drain := r.Drain
+	if drain == 0 {
+		drain = defaultDrain
+	}
+
+	var updated []int
+	for i := 1; i <= r.Count; i++ {
+		unit := replicaUnit(app.InstID, i)
+		port := replicaPort(app, i)
+		serving := slices.Contains(upstreams[app.InstID], port)
+		if serving && !d.changes.Any() {
+			continue
+		}
+
+		// without any other replica, the restart cannot be hidden from the proxy
+		others := slices.DeleteFunc(slices.Clone(upstreams[app.InstID]), func(p int) bool { return p == port })
+		if serving && len(others) > 0 {
+			logger.Info("taking replica out of the proxy", "unit", unit, "drain", drain)
+			if err := switchUpstreams(upstreams, app.InstID, others, switchProxy); err != nil {
+				return err
+			}
+
+			time.Sleep(drain)
+		}
+
+		logger.Info("starting replica", "unit", unit, "port", port)
+		if err := run.Command("systemctl", "enable", unit); err != nil {
+			logger.Warn("failed to enable replica", "unit", unit)
+		}
+
+		if err := run.Command("systemctl", "restart", unit); err != nil {
+			logger.Warn("failed to start replica", "unit", unit, "err", err.Error())
+		}
+
+		report.Restarted(app.InstID, unit)
+
+		if err := waitReady(logger, unit, port, r.ReadinessPath, r.Timeout); err != nil {
+			logger.Error("replica did not become ready", "unit", unit, "err", err.Error())
+			if err := run.Command("systemctl", "disable", "--now", unit); err != nil {
+				logger.Warn("failed to stop replica", "unit", unit)
+			}
+
+			if d.changes.Any() {
+				rollbackReplicas(logger, bus, d, updated, err, report)
+			}
+
+			return fmt.Errorf("replica %s did not become ready: %w", unit, err)
+		}
+
+		updated = append(updated, i)
+		ports := append(others, port)
+		slices.Sort(ports)
+		if err := switchUpstreams(upstreams, app.InstID, ports, switchProxy); err != nil {
+			return err
+		}
+	}
+
+	// e.g. the count has been decreased or the base port has changed
+	declared := replicaPorts(app)
+	if !slices.Equal(upstreams[app.InstID], declared) {
+		if err := switchUpstreams(upstreams, app.InstID, declared, switchProxy); err != nil {
+			return err
+		}
+
+		time.Sleep(drain)
+	}
+
+	return stopReplicas(logger, app.InstID, r.Count)
+}
+
+// rollbackReplicas puts the previous version back, so that the remaining replicas do not pick up the broken one,
+// when they get restarted later. The given replicas, which already run the new version, are restarted one after
+// another, thus all replicas serve the same version again.
+func rollbackReplicas(logger *slog.Logger, bus event.Bus, d deployment, updated []int, reason error, report *apply.Report) {
+	if !rollbackDeployment(logger, bus, d, reason, report) {
+		return
+	}
+
+	if err := run.Command("systemctl", "daemon-reload"); err != nil {
+		logger.Error("error reloading systemd daemon after rollback", "err", err.Error())
+	}
+
+	r := d.app.Replicas
+	for _, replica := range updated {
+		unit := replicaUnit(d.app.InstID, replica)
+		logger.Info("restart rolled back replica", "unit", unit)
+		if err := run.Command("systemctl", "restart", unit); err != nil {
+			logger.Warn("failed to restart rolled back replica", "unit", unit, "err", err.Error())
+			continue
+		}
+
+		report.Restarted(d.app.InstID, unit)
+		if err := waitReady(logger, unit, replicaPort(d.app, replica), r.ReadinessPath, r.Timeout); err != nil {
+			logger.Error("rolled back replica did not become ready", "unit", unit, "err", err.Error())
+		}
+	}
+}
+
+// switchUpstreams persists the ports which serve the instance and moves the traffic to them.
+func switchUpstreams(upstreams apply.Upstreams, instID string, ports []int, switchProxy ProxySwitch) error {
+	upstreams[instID] = ports
+	if err := upstreams.Save(); err != nil {
+		return err
+	}
+
+	if err := switchProxy(); err != nil {
+		return fmt.Errorf("cannot switch proxy of %s to ports %v: %w", instID, ports, err)
+	}
+
+	return nil
+}
+
+// stopReplicas stops and disables all replicas of the instance above the given count and removes their drop-ins.
+func stopReplicas(logger *slog.Logger, instID string, count int) error {
+	replicas, err := existingReplicas(instID)
+	if err != nil {
+		return err
+	}
+
+	removed := false
+	for _, replica := range replicas {
+		if replica <= count {
+			continue
+		}
+
+		unit := replicaUnit(instID, replica)
+		logger.Info("stopping surplus replica", "unit", unit)
+		if err := run.Command("systemctl", "disable", "--now", unit); err != nil {
+			logger.Warn("failed to stop replica", "unit", unit)
+		}
+
+		if err := os.RemoveAll(replicaDropInDir(instID, replica)); err != nil {
+			return fmt.Errorf("cannot remove replica drop-in: %w", err)
+		}
+
+		removed = true
+	}
+
+	if removed {
+		if err := run.Command("systemctl", "daemon-reload"); err != nil {
+			return fmt.Errorf("error reloading systemd daemon: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// removeReplicaDropIns removes the drop-ins of all replicas of the instance above the given count without
+// touching the units.
+func removeReplicaDropIns(instID string, count int) error {
+	replicas, err := existingReplicas(instID)
+	if err != nil {
+		return err
+	}
+
+	for _, replica := range replicas {
+		if replica <= count {
+			continue
+		}
+
+		if err := os.RemoveAll(replicaDropInDir(instID, replica)); err != nil {
+			return fmt.Errorf("cannot remove replica drop-in: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// existingReplicas returns the numbers of all replicas, which have a drop-in.
+func existingReplicas(instID string) ([]int, error) {
+	dirs, err := filepath.Glob(filepath.Join(systemdConfDir, instID+"@*.service.d"))
+	if err != nil {
+		return nil, err
+	}
+
+	var res []int
+	for _, dir := range dirs {
+		name := strings.TrimSuffix(filepath.Base(dir), ".service.d")
+		_, suffix, _ := strings.Cut(name, "@")
+		replica, err := strconv.Atoi(suffix)
+		if err != nil || replica <= 0 {
+			continue
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, replicaDropInName)); err != nil {
+			continue
+		}
+
+		res = append(res, replica)
+	}
+
+	slices.Sort(res)
+	return res, nil
+}
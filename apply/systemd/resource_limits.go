@@ -0,0 +1,90 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package systemd
+
+import (
+	"github.com/worldiety/nago-runner/apply"
+	"github.com/worldiety/nago-runner/configuration"
+	"github.com/worldiety/nago-runner/pkg/linux"
+	"github.com/worldiety/nago-runner/service/event"
+	"log/slog"
+)
+
+// reportLimits records the effective resource limits of the main unit of each instance, because the declared
+// limits may be capped by the slice of the unit or by the defaults of systemd.
+func reportLimits(logger *slog.Logger, cfg configuration.Runner, upstreams apply.Upstreams, report *apply.Report) {
+	for _, app := range cfg.Applications {
+		unit := mainUnit(app, upstreams)
+		if unit == "" {
+			continue
+		}
+
+		limits, err := resourceLimits(unit)
+		if err != nil {
+			logger.Error("cannot inspect resource limits", "unit", unit, "err", err.Error())
+			continue
+		}
+
+		report.Update(app.InstID, func(instance *event.InstanceApplied) {
+			instance.Limits = limits
+		})
+	}
+}
+
+// resourceLimits inspects the effective resource limits of the given unit.
+func resourceLimits(unit string) (*event.ResourceLimits, error) {
+	props, err := linux.ServicePropertyValues(unit,
+		"MemoryHigh", "MemoryMax", "EffectiveMemoryMax", "TasksMax", "EffectiveTasksMax", "IOWeight",
+		"IOReadBandwidthMax", "IOWriteBandwidthMax", "LimitNOFILE", "LimitNOFILESoft", "CPUQuotaPerSecUSec",
+		"CPUAffinity")
+	if err != nil {
+		return nil, err
+	}
+
+	first := func(key string) string {
+		if len(props[key]) == 0 {
+			return ""
+		}
+
+		return props[key][0]
+	}
+
+	return &event.ResourceLimits{
+		Unit:                unit,
+		MemoryHigh:          first("MemoryHigh"),
+		MemoryMax:           first("MemoryMax"),
+		EffectiveMemoryMax:  first("EffectiveMemoryMax"),
+		TasksMax:            first("TasksMax"),
+		EffectiveTasksMax:   first("EffectiveTasksMax"),
+		IOWeight:            first("IOWeight"),
+		IOReadBandwidthMax:  props["IOReadBandwidthMax"],
+		IOWriteBandwidthMax: props["IOWriteBandwidthMax"],
+		LimitNOFILE:         first("LimitNOFILE"),
+		LimitNOFILESoft:     first("LimitNOFILESoft"),
+		CPUQuotaPerSecUSec:  first("CPUQuotaPerSecUSec"),
+		CPUAffinity:         first("CPUAffinity"),
+	}, nil
+}
+
+// mainUnit returns the unit which runs the instance or the empty string, if there is none yet. All replicas share
+// the same limits, thus only the first one is returned.
+func mainUnit(app configuration.Application, upstreams apply.Upstreams) string {
+	if usesReplicas(app) {
+		return replicaUnit(app.InstID, 1) + ".service"
+	}
+
+	if !usesBlueGreen(app) {
+		return app.InstID + ".service"
+	}
+
+	if slot := activeSlot(app, upstreams); slot != "" {
+		return slotUnit(app.InstID, slot) + ".service"
+	}
+
+	return ""
+}
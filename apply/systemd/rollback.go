@@ -0,0 +1,352 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package systemd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/worldiety/nago-runner/apply"
+	"github.com/worldiety/nago-runner/apply/health"
+	"github.com/worldiety/nago-runner/configuration"
+	"github.com/worldiety/nago-runner/pkg/linux"
+	"github.com/worldiety/nago-runner/pkg/run"
+	"github.com/worldiety/nago-runner/service/event"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	prevSuffix         = ".prev"
+	defaultGracePeriod = 30 * time.Second
+	rollbacksFile      = "/var/lib/nago-runner/rollbacks.json"
+)
+
+// declarationHash identifies the declaration of an application, so that a rolled back declaration is recognized
+// by the next apply.
+func declarationHash(app configuration.Application) (configuration.Sha3V512, error) {
+	buf, err := json.Marshal(app)
+	if err != nil {
+		return "", fmt.Errorf("cannot marshal declaration: %w", err)
+	}
+
+	return linux.Sha3Bytes(buf)
+}
+
+// loadRollbacks returns the hash of the rolled back declaration by instance id. It survives runner restarts, so
+// that neither the hub nor a drift repair installs a broken version again.
+func loadRollbacks() (map[string]configuration.Sha3V512, error) {
+	res := map[string]configuration.Sha3V512{}
+	buf, err := os.ReadFile(rollbacksFile)
+	if os.IsNotExist(err) {
+		return res, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot read rollbacks: %w", err)
+	}
+
+	if err := json.Unmarshal(buf, &res); err != nil {
+		return nil, fmt.Errorf("cannot parse rollbacks: %s: %w", rollbacksFile, err)
+	}
+
+	return res, nil
+}
+
+func saveRollbacks(rollbacks map[string]configuration.Sha3V512) error {
+	buf, err := json.Marshal(rollbacks)
+	if err != nil {
+		return err
+	}
+
+	if err := linux.WriteFile(rollbacksFile, buf, 0600); err != nil {
+		return fmt.Errorf("cannot write rollbacks: %w", err)
+	}
+
+	return nil
+}
+
+// rememberRollback records the declaration of the application as rolled back.
+func rememberRollback(app configuration.Application) (configuration.Sha3V512, error) {
+	hash, err := declarationHash(app)
+	if err != nil {
+		return "", err
+	}
+
+	rollbacks, err := loadRollbacks()
+	if err != nil {
+		return "", err
+	}
+
+	rollbacks[app.InstID] = hash
+	return hash, saveRollbacks(rollbacks)
+}
+
+// rolledBackDeclaration returns the hash of the declaration, if it has been rolled back before and must not be applied
+// again. Otherwise, the hash is empty.
+func rolledBackDeclaration(app configuration.Application) (configuration.Sha3V512, error) {
+	rollbacks, err := loadRollbacks()
+	if err != nil {
+		return "", err
+	}
+
+	hash, err := declarationHash(app)
+	if err != nil {
+		return "", err
+	}
+
+	if rollbacks[app.InstID] != hash {
+		return "", nil
+	}
+
+	return hash, nil
+}
+
+// forgetRollbacks removes the recorded rollbacks of all instances, whose declaration has changed since or which
+// are not declared anymore, thus their declaration is applied again.
+func forgetRollbacks(logger *slog.Logger, apps []configuration.Application) error {
+	rollbacks, err := loadRollbacks()
+	if err != nil || len(rollbacks) == 0 {
+		return err
+	}
+
+	keep := map[string]configuration.Sha3V512{}
+	for _, app := range apps {
+		hash, err := declarationHash(app)
+		if err != nil {
+			return err
+		}
+
+		if rollbacks[app.InstID] == hash {
+			keep[app.InstID] = hash
+		}
+	}
+
+	if len(keep) == len(rollbacks) {
+		return nil
+	}
+
+	for instID := range rollbacks {
+		if _, ok := keep[instID]; !ok {
+			logger.Info("declaration has changed since rollback", "instance", instID)
+		}
+	}
+
+	return saveRollbacks(keep)
+}
+
+// keepPrevious preserves the current version of the given file next to it, before it gets replaced.
+func keepPrevious(filename string) error {
+	prev := filename + prevSuffix
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		// first deployment, there is nothing to keep
+		_ = os.Remove(prev)
+		return nil
+	}
+
+	if err := os.Remove(prev); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove previous version: %s: %w", prev, err)
+	}
+
+	if err := os.Link(filename, prev); err != nil {
+		return fmt.Errorf("cannot keep previous version: %s: %w", prev, err)
+	}
+
+	return nil
+}
+
+// restorePrevious puts the previous version of the given file back. It returns false, if there was no
+// previous version.
+func restorePrevious(filename string) (bool, error) {
+	prev := filename + prevSuffix
+	if _, err := os.Stat(prev); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	if err := os.Rename(prev, filename); err != nil {
+		return false, fmt.Errorf("cannot restore previous version: %s: %w", filename, err)
+	}
+
+	return true, nil
+}
+
+// verifyDeployments watches all restarted services concurrently and rolls back those, which declare a rollback
+// and do not become healthy within their grace period.
+func verifyDeployments(logger *slog.Logger, bus event.Bus, deployments []deployment, report *apply.Report) {
+	failures := make([]error, len(deployments))
+	var wg sync.WaitGroup
+	for i, d := range deployments {
+		if !d.app.Rollback.Enabled {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			failures[i] = watchService(logger, d.service, d.app.Rollback, usesSocket(d.app))
+		}()
+	}
+
+	wg.Wait()
+
+	var rolledBack []deployment
+	for i, d := range deployments {
+		if failures[i] == nil {
+			continue
+		}
+
+		logger.Error("service did not become healthy, rolling back", "service", d.service.Name(), "err", failures[i].Error())
+		report.Fail(d.app.InstID, failures[i])
+		if rollbackDeployment(logger, bus, d, failures[i], report) {
+			rolledBack = append(rolledBack, d)
+		}
+	}
+
+	if len(rolledBack) == 0 {
+		return
+	}
+
+	if err := run.Command("systemctl", "daemon-reload"); err != nil {
+		logger.Error("error reloading systemd daemon after rollback", "err", err.Error())
+	}
+
+	for _, d := range rolledBack {
+		logger.Info("restart rolled back service", "service", d.service.Name())
+		if err := run.Command("systemctl", "restart", d.service.Name()); err != nil {
+			slog.Warn("failed to restart rolled back service, ignoring", "service", d.service.Name())
+		}
+	}
+}
+
+// rollbackDeployment puts the previous version of the failed deployment back, publishes and reports the rollback
+// and remembers the declaration, thus the following applies skip it until it changes. It returns false, if the
+// previous version cannot be restored. Reloading systemd and restarting the affected units is up to the caller.
+func rollbackDeployment(logger *slog.Logger, bus event.Bus, d deployment, reason error, report *apply.Report) bool {
+	if err := rollback(d); err != nil {
+		logger.Error("cannot roll back service", "service", d.service.Name(), "err", err.Error())
+		bus.Publish(event.RollbackPerformed{
+			InstanceID: d.app.InstID,
+			Reason:     reason.Error(),
+			Error:      err.Error(),
+		})
+		return false
+	}
+
+	hash, err := rememberRollback(d.app)
+	if err != nil {
+		logger.Error("cannot remember rollback", "instance", d.app.InstID, "err", err.Error())
+	}
+
+	report.Update(d.app.InstID, func(instance *event.InstanceApplied) {
+		instance.RolledBack = true
+		instance.RolledBackHash = string(hash)
+	})
+	bus.Publish(event.RollbackPerformed{
+		InstanceID: d.app.InstID,
+		Reason:     reason.Error(),
+	})
+
+	return true
+}
+
+// rollback restores the previous executable and unit file, if they have been changed by the deployment.
+func rollback(d deployment) error {
+	var restored bool
+	if d.changes.Executable && usesArtifacts(d.app) {
+		ok, err := restorePreviousArtifacts(d.app.InstID)
+		if err != nil {
+			return err
+		}
+
+		restored = restored || ok
+	}
+
+	if d.changes.Executable && !restored {
+		ok, err := restorePrevious(d.service.Paths().ExecFilename)
+		if err != nil {
+			return err
+		}
+
+		restored = restored || ok
+	}
+
+	if d.changes.Unit {
+		ok, err := restorePrevious(d.service.UnitFilename)
+		if err != nil {
+			return err
+		}
+
+		restored = restored || ok
+	}
+
+	if !restored {
+		return errors.New("no previous version available")
+	}
+
+	return nil
+}
+
+// watchService observes a freshly restarted service for the configured grace period. It returns an error, if the
+// service fails, gets restarted again by systemd or never passes the readiness probe. A socket activated service
+// may also stay inactive until its first request.
+func watchService(logger *slog.Logger, service Service, rollback configuration.Rollback, socketActivated bool) error {
+	grace := rollback.GracePeriod
+	if grace == 0 {
+		grace = defaultGracePeriod
+	}
+
+	props, err := linux.ServiceProperties(service.Name(), "NRestarts")
+	if err != nil {
+		return err
+	}
+
+	restarts := props["NRestarts"]
+	ready := !rollback.Readiness.Declared()
+	deadline := time.Now().Add(grace)
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+
+		props, err = linux.ServiceProperties(service.Name(), "ActiveState", "NRestarts")
+		if err != nil {
+			return err
+		}
+
+		if props["ActiveState"] == "failed" {
+			if err := hookFailure(service.Name()); err != nil {
+				return err
+			}
+
+			return errors.New("service has failed")
+		}
+
+		if props["NRestarts"] != restarts {
+			return fmt.Errorf("service has been restarted by systemd: %s -> %s", restarts, props["NRestarts"])
+		}
+
+		if !ready {
+			if err := health.Probe(context.Background(), rollback.Readiness); err != nil {
+				logger.Info("readiness probe not yet passed", "service", service.Name(), "err", err.Error())
+			} else {
+				ready = true
+			}
+		}
+	}
+
+	if props["ActiveState"] != "active" && !(socketActivated && props["ActiveState"] == "inactive") {
+		return fmt.Errorf("service is not active after grace period: %s", props["ActiveState"])
+	}
+
+	if !ready {
+		return errors.New("readiness probe did not pass within grace period")
+	}
+
+	return nil
+}
@@ -18,11 +18,18 @@ import (
 	"unicode/utf8"
 )
 
-// Service represents a systemd service unit on disk.
+// execRoot contains the executables of all instances and their artifact directories <inst>.d.
+const execRoot = "/opt/ngr"
+
+// Service represents a systemd unit on disk, usually a service but also the timer of a job.
 type Service struct {
 	UnitFilename  string
 	Configuration configuration.ServiceUnit
-	Managed       bool
+	// Application is the declaration from which a managed unit has been generated. Secrets have been redacted.
+	Application configuration.Application
+	// Job is set, if the unit belongs to a job of the Application.
+	Job     configuration.Name
+	Managed bool
 }
 
 // NewService creates a managed instance without a configuration.
@@ -47,39 +54,73 @@ func ParseService(logger *slog.Logger, filename string) (Service, error) {
 	res := Service{UnitFilename: filename}
 	for line := range strings.Lines(string(buf)) {
 		if strings.HasPrefix(line, ngrMetaPrefix) {
-			var tmp configuration.ServiceUnit
+			// the header contains the entire application declaration, see also renderUnit
+			var tmp configuration.Application
 			if err := json.Unmarshal([]byte(line[len(ngrMetaPrefix):]), &tmp); err != nil {
-				logger.Error("failed to parse managed systemd conf file: %s: %s", filename, err)
+				logger.Error("failed to parse managed systemd conf file", "file", filename, "err", err.Error())
 				break
 			}
 			res.Managed = true
-			res.Configuration = tmp
+			res.Application = tmp
+			res.Configuration = tmp.Sandbox.Unit
+		}
+
+		if strings.HasPrefix(line, ngrJobPrefix) {
+			res.Job = configuration.Name(strings.TrimSpace(line[len(ngrJobPrefix):]))
 		}
 	}
 
 	return res, nil
 }
 
+// Name returns the unit name without its type suffix.
 func (s Service) Name() string {
-	return strings.TrimSuffix(strings.ToLower(filepath.Base(s.UnitFilename)), ".service")
+	base := strings.ToLower(filepath.Base(s.UnitFilename))
+	return strings.TrimSuffix(base, filepath.Ext(base))
 }
 
-func (s Service) Paths() Paths {
-	p := Paths{
-		DataDirectory: "/var/lib/ngr/" + s.Name(),
-		ExecFilename:  "/opt/ngr/" + s.Name(),
-	}
+// Type returns the unit type like service or timer.
+func (s Service) Type() string {
+	return strings.TrimPrefix(strings.ToLower(filepath.Ext(s.UnitFilename)), ".")
+}
 
-	if s.Configuration.Service.ExecStart.Cmd != "" {
-		p.ExecFilename = s.Configuration.Service.ExecStart.Cmd
+// InstanceID returns the declared instance which owns the unit. A template like my-app@.service belongs to my-app.
+func (s Service) InstanceID() string {
+	if s.Application.InstID != "" {
+		return strings.ToLower(s.Application.InstID)
 	}
 
-	if s.Configuration.Service.StateDirectory != "" {
-		// state directory must be relative and is placed inside /var/lib/
-		p.DataDirectory = filepath.Join("/var/lib/", s.Configuration.Service.StateDirectory)
+	id, _, _ := strings.Cut(s.Name(), "@")
+	return id
+}
+
+// Template returns true, if the unit is a template like my-app@.service, which is only started through its
+// instances like my-app@blue.
+func (s Service) Template() bool {
+	return strings.HasSuffix(s.Name(), "@")
+}
+
+// Unit returns the name to control the unit by systemctl. For a template, this is a pattern which matches
+// all of its loaded instances.
+func (s Service) Unit() string {
+	switch {
+	case s.Type() != "service":
+		return s.Name() + "." + s.Type()
+	case s.Template():
+		return s.Name() + "*"
+	default:
+		return s.Name()
 	}
+}
 
-	return p
+// Paths returns the executable and the data directory, which are owned by the runner. They never depend on the
+// declared ExecStart or StateDirectory, because they are backed up and deleted for good when the instance is purged,
+// and a declaration like ExecStart=/usr/bin/java must never cause a shared system file to be deleted.
+func (s Service) Paths() Paths {
+	return Paths{
+		DataDirectory: filepath.Join(dataRoot, s.InstanceID()),
+		ExecFilename:  filepath.Join(execRoot, s.InstanceID()),
+	}
 }
 
 type Paths struct {
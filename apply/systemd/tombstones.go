@@ -0,0 +1,357 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package systemd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/worldiety/nago-runner/apply"
+	"github.com/worldiety/nago-runner/configuration"
+	"github.com/worldiety/nago-runner/pkg/linux"
+	"github.com/worldiety/nago-runner/pkg/run"
+	"github.com/worldiety/nago-runner/service/event"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tombstonesFile          = "/var/lib/nago-runner/tombstones.json"
+	defaultPurgeGracePeriod = 7 * 24 * time.Hour
+	defaultPurgeMaxPercent  = 50
+)
+
+// FinalBackup backs up the executable and the data directory of the given instance, which are exactly the Paths
+// deleted by the purge. It must return an error, if anything has not been stored, because the instance is
+// considered backed up otherwise.
+type FinalBackup func(instID string) error
+
+// tombstoneMutex guards the tombstones file, which is modified by the apply and by the final backups.
+var tombstoneMutex sync.Mutex
+
+// loadTombstones returns the persisted tombstones. A damaged file is an error, because forgetting a tombstone
+// would keep its data forever and forgetting its backup state could delete data without a backup.
+func loadTombstones() (map[string]event.Tombstone, error) {
+	res := map[string]event.Tombstone{}
+	buf, err := os.ReadFile(tombstonesFile)
+	if os.IsNotExist(err) {
+		return res, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot read tombstones: %w", err)
+	}
+
+	if err := json.Unmarshal(buf, &res); err != nil {
+		return nil, fmt.Errorf("cannot parse tombstones: %s: %w", tombstonesFile, err)
+	}
+
+	return res, nil
+}
+
+func saveTombstones(tombstones map[string]event.Tombstone) error {
+	buf, err := json.Marshal(tombstones)
+	if err != nil {
+		return err
+	}
+
+	if err := linux.WriteFile(tombstonesFile, buf, 0600); err != nil {
+		return fmt.Errorf("cannot write tombstones: %w", err)
+	}
+
+	return nil
+}
+
+// Tombstones returns all instances, which wait to be purged, ordered by their instance id.
+func Tombstones() ([]event.Tombstone, error) {
+	tombstoneMutex.Lock()
+	defer tombstoneMutex.Unlock()
+
+	tombstones, err := loadTombstones()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]event.Tombstone, 0, len(tombstones))
+	for _, t := range tombstones {
+		res = append(res, t)
+	}
+
+	slices.SortFunc(res, func(a, b event.Tombstone) int {
+		return strings.Compare(a.InstanceID, b.InstanceID)
+	})
+
+	return res, nil
+}
+
+// CheckRemoval returns an error, if applying the given configuration would turn more than the allowed percentage
+// of all running instances into tombstones at once. It must be called before anything is applied, because such a
+// configuration is refused as a whole.
+func CheckRemoval(logger *slog.Logger, cfg configuration.Runner) error {
+	keepServices, removeServices, staleServices, err := categorizeServices(logger, cfg)
+	if err != nil {
+		return fmt.Errorf("cannot categorize services: %w", err)
+	}
+
+	tombstoneMutex.Lock()
+	defer tombstoneMutex.Unlock()
+
+	tombstones, err := loadTombstones()
+	if err != nil {
+		return err
+	}
+
+	return checkRemoval(cfg.Purge, countInstances(keepServices, staleServices), freshTombstones(tombstones, removeServices))
+}
+
+// freshTombstones returns the instances of the given services, which are not tombstones yet.
+func freshTombstones(tombstones map[string]event.Tombstone, toRemove []Service) []string {
+	var fresh []string
+	for _, service := range toRemove {
+		id := service.InstanceID()
+		if _, ok := tombstones[id]; !ok && !slices.Contains(fresh, id) {
+			fresh = append(fresh, id)
+		}
+	}
+
+	return fresh
+}
+
+// checkRemoval refuses to turn more than the allowed percentage of all running instances, which are the given
+// number of declared instances and the fresh tombstones, into tombstones at once.
+func checkRemoval(policy configuration.Purge, instances int, fresh []string) error {
+	maxPercent := policy.MaxPercent
+	if maxPercent <= 0 {
+		maxPercent = defaultPurgeMaxPercent
+	}
+
+	total := instances + len(fresh)
+	if len(fresh) > 1 && len(fresh)*100 > maxPercent*total {
+		return fmt.Errorf("refusing to remove %d of %d instances, which exceeds %d%%: %s", len(fresh), total, maxPercent, strings.Join(fresh, ", "))
+	}
+
+	return nil
+}
+
+// tombstoneServices stops and disables all units of undeclared instances, which are not tombstones yet, and
+// records them as tombstones. Nothing is deleted. If more than the allowed percentage of all running instances,
+// which are the given number of declared instances and the new tombstones, would become tombstones at once,
+// nothing is done at all.
+func tombstoneServices(logger *slog.Logger, policy configuration.Purge, instances int, toRemove []Service, report *apply.Report) error {
+	tombstoneMutex.Lock()
+	defer tombstoneMutex.Unlock()
+
+	tombstones, err := loadTombstones()
+	if err != nil {
+		return err
+	}
+
+	fresh := freshTombstones(tombstones, toRemove)
+	if len(fresh) == 0 {
+		return nil
+	}
+
+	if err := checkRemoval(policy, instances, fresh); err != nil {
+		return err
+	}
+
+	for _, service := range toRemove {
+		if !slices.Contains(fresh, service.InstanceID()) {
+			continue
+		}
+
+		logger.Warn("stopping undeclared managed service", "service", service.Name())
+		if err := run.Command("systemctl", "stop", service.Unit()); err != nil {
+			slog.Warn("failed to stop service, ignoring", "service", service.Name())
+		}
+
+		if err := disableService(service); err != nil {
+			return err
+		}
+	}
+
+	grace := policy.GracePeriod
+	if grace <= 0 {
+		grace = defaultPurgeGracePeriod
+	}
+
+	now := time.Now()
+	for _, id := range fresh {
+		logger.Warn("instance became a tombstone", "instance", id, "purgeAfter", now.Add(grace))
+		tombstones[id] = event.Tombstone{InstanceID: id, Since: now, PurgeAfter: now.Add(grace)}
+		report.Tombstoned(id)
+	}
+
+	return saveTombstones(tombstones)
+}
+
+// resurrect forgets the tombstone of a declared instance and returns true, if there was one.
+func resurrect(logger *slog.Logger, instID string) (bool, error) {
+	tombstoneMutex.Lock()
+	defer tombstoneMutex.Unlock()
+
+	tombstones, err := loadTombstones()
+	if err != nil {
+		return false, err
+	}
+
+	if _, ok := tombstones[instID]; !ok {
+		return false, nil
+	}
+
+	logger.Info("resurrecting tombstone", "instance", instID)
+	delete(tombstones, instID)
+	return true, saveTombstones(tombstones)
+}
+
+// tombstoned returns true, if the instance is a tombstone.
+func tombstoned(instID string) (bool, error) {
+	tombstoneMutex.Lock()
+	defer tombstoneMutex.Unlock()
+
+	tombstones, err := loadTombstones()
+	if err != nil {
+		return false, err
+	}
+
+	_, ok := tombstones[instID]
+	return ok, nil
+}
+
+// ConfirmPurge marks the tombstone to be purged without waiting for its grace period or its final backup.
+func ConfirmPurge(instID string) error {
+	tombstoneMutex.Lock()
+	defer tombstoneMutex.Unlock()
+
+	tombstones, err := loadTombstones()
+	if err != nil {
+		return err
+	}
+
+	t, ok := tombstones[instID]
+	if !ok {
+		return fmt.Errorf("instance is not a tombstone: %s", instID)
+	}
+
+	t.Confirmed = true
+	tombstones[instID] = t
+	return saveTombstones(tombstones)
+}
+
+// BackupTombstones takes the final backup of every tombstone, which has not been backed up yet. A failed backup
+// is retried on the next call. The backups run without holding any lock, because they may take a long time.
+func BackupTombstones(logger *slog.Logger, backup FinalBackup) error {
+	tombstones, err := Tombstones()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, t := range tombstones {
+		if !t.BackedUpAt.IsZero() || t.Confirmed {
+			continue
+		}
+
+		logger.Info("taking final backup", "instance", t.InstanceID)
+		berr := backup(t.InstanceID)
+		if berr != nil {
+			logger.Error("final backup failed", "instance", t.InstanceID, "err", berr.Error())
+			errs = append(errs, fmt.Errorf("%s: %w", t.InstanceID, berr))
+		}
+
+		if err := recordBackup(t.InstanceID, berr); err != nil {
+			return err
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func recordBackup(instID string, backupErr error) error {
+	tombstoneMutex.Lock()
+	defer tombstoneMutex.Unlock()
+
+	tombstones, err := loadTombstones()
+	if err != nil {
+		return err
+	}
+
+	// the instance may have been declared again in the meantime
+	t, ok := tombstones[instID]
+	if !ok {
+		return nil
+	}
+
+	if backupErr != nil {
+		t.BackupError = backupErr.Error()
+	} else {
+		t.BackedUpAt = time.Now()
+		t.BackupError = ""
+	}
+
+	tombstones[instID] = t
+	return saveTombstones(tombstones)
+}
+
+// PurgeTombstones deletes the executable, the data and the units of every tombstone, which has been confirmed or
+// whose grace period has passed after a successful final backup. It must not run concurrently with Apply.
+func PurgeTombstones(logger *slog.Logger, bus event.Bus) error {
+	tombstoneMutex.Lock()
+	defer tombstoneMutex.Unlock()
+
+	tombstones, err := loadTombstones()
+	if err != nil {
+		return err
+	}
+
+	services, err := FindServices(logger)
+	if err != nil {
+		return fmt.Errorf("failed to find systemd units: %w", err)
+	}
+
+	var errs []error
+	now := time.Now()
+	for id, t := range tombstones {
+		if !t.Confirmed && (t.BackedUpAt.IsZero() || now.Before(t.PurgeAfter)) {
+			continue
+		}
+
+		var owned []Service
+		for _, service := range services {
+			if service.Managed && service.InstanceID() == id {
+				owned = append(owned, service)
+			}
+		}
+
+		if len(owned) == 0 {
+			// the units have been removed by hand, thus delete the files at their conventional paths
+			owned = append(owned, NewService(id))
+		}
+
+		evt := event.InstancePurged{InstanceID: id, Confirmed: t.Confirmed, BackedUpAt: t.BackedUpAt}
+		if err := purgeServices(logger, owned, nil); err != nil {
+			evt.Error = err.Error()
+			errs = append(errs, fmt.Errorf("%s: %w", id, err))
+			bus.Publish(evt)
+			continue
+		}
+
+		delete(tombstones, id)
+		bus.Publish(evt)
+	}
+
+	if err := saveTombstones(tombstones); err != nil {
+		return err
+	}
+
+	return errors.Join(errs...)
+}
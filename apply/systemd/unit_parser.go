@@ -0,0 +1,516 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package systemd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/worldiety/nago-runner/configuration"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unitEntry is a single key=value assignment of a unit file.
+type unitEntry struct {
+	Line  int
+	Key   string
+	Value string
+}
+
+// unitSection is a named section of a unit file with its assignments in file order.
+type unitSection struct {
+	Name    string
+	Entries []unitEntry
+}
+
+// parseUnitFile splits a unit file into its sections according to systemd.syntax(7). Comments, empty lines and
+// line continuations are handled, values are returned with all escapes still in place.
+func parseUnitFile(buf []byte) ([]unitSection, error) {
+	var sections []unitSection
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		start := lineNo
+		for strings.HasSuffix(line, "\\") && scanner.Scan() {
+			lineNo++
+			next := strings.TrimSpace(scanner.Text())
+			if strings.HasPrefix(next, "#") || strings.HasPrefix(next, ";") {
+				continue
+			}
+
+			line = strings.TrimSuffix(line, "\\") + " " + next
+		}
+
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: invalid section header: %s", start, line)
+			}
+
+			sections = append(sections, unitSection{Name: line[1 : len(line)-1]})
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: missing '=': %s", start, line)
+		}
+
+		if len(sections) == 0 {
+			return nil, fmt.Errorf("line %d: assignment outside of a section: %s", start, line)
+		}
+
+		sec := &sections[len(sections)-1]
+		sec.Entries = append(sec.Entries, unitEntry{Line: start, Key: strings.TrimSpace(key), Value: strings.TrimSpace(value)})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return sections, nil
+}
+
+// ParseUnit reads a unit file, as rendered for a managed service, back into its declaration. Unknown sections or
+// keys are rejected, because the result is used to verify that the renderer has not lost any information.
+func ParseUnit(buf []byte) (configuration.ServiceUnit, error) {
+	var unit configuration.ServiceUnit
+	sections, err := parseUnitFile(buf)
+	if err != nil {
+		return unit, err
+	}
+
+	for _, sec := range sections {
+		for _, e := range sec.Entries {
+			var err error
+			switch sec.Name {
+			case "Unit":
+				err = decodeUnitEntry(&unit.Unit, e)
+			case "Service":
+				err = decodeServiceEntry(&unit.Service, e)
+			case "Install":
+				err = decodeInstallEntry(&unit.Install, e)
+			default:
+				err = fmt.Errorf("unsupported section [%s]", sec.Name)
+			}
+
+			if err != nil {
+				return unit, fmt.Errorf("line %d: %s: %w", e.Line, e.Key, err)
+			}
+		}
+	}
+
+	return unit, nil
+}
+
+func decodeUnitEntry(unit *configuration.UnitSection, e unitEntry) error {
+	var err error
+	switch e.Key {
+	case "Description":
+		unit.Description, err = unescapeSpecifiers(e.Value)
+	case "After":
+		var after string
+		after, err = unescapeSpecifiers(e.Value)
+		if unit.After == "" && len(unit.AfterUnits) == 0 {
+			unit.After = configuration.Name(after)
+		} else {
+			unit.AfterUnits = append(unit.AfterUnits, configuration.Name(after))
+		}
+	case "Requires":
+		var name string
+		name, err = unescapeSpecifiers(e.Value)
+		unit.Requires = append(unit.Requires, configuration.Name(name))
+	case "Wants":
+		var name string
+		name, err = unescapeSpecifiers(e.Value)
+		unit.Wants = append(unit.Wants, configuration.Name(name))
+	case "BindsTo":
+		var name string
+		name, err = unescapeSpecifiers(e.Value)
+		unit.BindsTo = append(unit.BindsTo, configuration.Name(name))
+	default:
+		return fmt.Errorf("unsupported key")
+	}
+
+	return err
+}
+
+func decodeInstallEntry(install *configuration.InstallSection, e unitEntry) error {
+	var err error
+	switch e.Key {
+	case "WantedBy":
+		install.WantedBy, err = unescapeSpecifiers(e.Value)
+	default:
+		return fmt.Errorf("unsupported key")
+	}
+
+	return err
+}
+
+func decodeServiceEntry(service *configuration.ServiceSection, e unitEntry) error {
+	var err error
+	v := e.Value
+	switch e.Key {
+	case "Type":
+		service.Type = configuration.Type(v)
+	case "User":
+		service.User, err = unescapeSpecifiers(v)
+	case "Group":
+		service.Group, err = unescapeSpecifiers(v)
+	case "BindPaths":
+		service.BindPaths, err = unescapeSpecifiers(v)
+	case "BindReadOnlyPaths":
+		service.BindReadOnlyPaths, err = unescapeSpecifiers(v)
+	case "ReadOnlyPaths":
+		service.ReadOnlyPaths, err = unescapeSpecifiers(v)
+	case "ReadWritePaths":
+		service.ReadWritePaths, err = unescapeSpecifiers(v)
+	case "InaccessiblePaths":
+		service.InaccessiblePaths, err = unescapeSpecifiers(v)
+	case "ExecPaths":
+		service.ExecPaths, err = unescapeSpecifiers(v)
+	case "AppArmorProfile":
+		service.AppArmorProfile, err = unescapeSpecifiers(v)
+	case "StateDirectory":
+		service.StateDirectory, err = unescapeSpecifiers(v)
+	case "SystemCallFilter":
+		service.SystemCallFilter = v
+	case "PrivateTmp":
+		service.PrivateTmp, err = parseBoolean(v)
+	case "MemoryDenyWriteExecute":
+		service.MemoryDenyWriteExecute, err = parseBoolean(v)
+	case "DynamicUser":
+		service.DynamicUser, err = parseBoolean(v)
+	case "RemoveIPC":
+		service.RemoveIPC, err = parseBoolean(v)
+	case "NoNewPrivileges":
+		service.NoNewPrivileges, err = parseBoolean(v)
+	case "PrivateDevices":
+		service.PrivateDevices, err = parseBoolean(v)
+	case "PrivateIPC":
+		service.PrivateIPC, err = parseBoolean(v)
+	case "PrivatePIDs":
+		service.PrivatePIDs, err = parseBoolean(v)
+	case "PrivateMounts":
+		service.PrivateMounts, err = parseBoolean(v)
+	case "PrivateNetwork":
+		service.PrivateNetwork, err = parseBoolean(v)
+	case "PrivateUsers":
+		service.PrivateUsers = configuration.PrivateUsers(v)
+	case "ProtectKernelModules":
+		service.ProtectKernelModules, err = parseBoolean(v)
+	case "ProtectKernelTunables":
+		service.ProtectKernelTunables, err = parseBoolean(v)
+	case "ProtectClock":
+		service.ProtectClock, err = parseBoolean(v)
+	case "ProtectKernelLogs":
+		service.ProtectKernelLogs, err = parseBoolean(v)
+	case "ProtectHostname":
+		service.ProtectHostname, err = parseBoolean(v)
+	case "SetLoginEnvironment":
+		service.SetLoginEnvironment, err = parseBoolean(v)
+	case "RestrictSUIDSGID":
+		service.RestrictSUIDSGID, err = parseBoolean(v)
+	case "RestrictRealtime":
+		service.RestrictRealtime, err = parseBoolean(v)
+	case "RestrictNamespaces":
+		service.RestrictNamespaces = append(service.RestrictNamespaces, configuration.RestrictNamespaces(v))
+	case "ProtectHome":
+		service.ProtectHome = configuration.ProtectHome(v)
+	case "ProtectSystem":
+		service.ProtectSystem = configuration.ProtectSystem(v)
+	case "ProtectControlGroups":
+		service.ProtectControlGroups = configuration.ProtectControlGroups(v)
+	case "ProtectProc":
+		service.ProtectProc = configuration.ProtectProc(v)
+	case "ExecStart":
+		service.ExecStart, err = parseCommand(v)
+	case "ExecStartPre":
+		service.ExecStartPre, err = appendCommand(service.ExecStartPre, v)
+	case "ExecStartPost":
+		service.ExecStartPost, err = appendCommand(service.ExecStartPost, v)
+	case "ExecStop":
+		service.ExecStop, err = appendCommand(service.ExecStop, v)
+	case "ExecReload":
+		service.ExecReload, err = appendCommand(service.ExecReload, v)
+	case "Environment":
+		var vars []configuration.EnvVar
+		vars, err = parseEnvironment(v)
+		service.Environment = append(service.Environment, vars...)
+	case "EnvironmentFile":
+		service.EnvironmentFile = append(service.EnvironmentFile, v)
+	case "LoadCredential":
+		var cred string
+		cred, err = unescapeSpecifiers(v)
+		service.LoadCredential = append(service.LoadCredential, cred)
+	case "LoadCredentialEncrypted":
+		var cred string
+		cred, err = unescapeSpecifiers(v)
+		service.LoadCredentialEncrypted = append(service.LoadCredentialEncrypted, cred)
+	case "CapabilityBoundingSet":
+		service.CapabilityBoundingSet = append(service.CapabilityBoundingSet, configuration.CapabilityBoundingSet(v))
+	case "Restart":
+		service.Restart = configuration.Restart(v)
+	case "RestartSec":
+		service.RestartSec, err = parseTimespan(v)
+	case "MemoryHigh":
+		service.MemoryHigh = configuration.Memory(v)
+	case "MemorySwapMax":
+		service.MemorySwapMax = configuration.Memory(v)
+	case "StartupMemoryHigh":
+		service.StartupMemoryHigh = configuration.Memory(v)
+	case "StartupMemorySwapMax":
+		service.StartupMemorySwapMax = configuration.Memory(v)
+	case "OOMPolicy":
+		service.OOMPolicy = configuration.OOMPolicy(v)
+	case "OOMScoreAdjust":
+		service.OOMScoreAdjust, err = strconv.Atoi(v)
+	case "CPUWeight":
+		service.CPUWeight, err = strconv.Atoi(v)
+	case "CPUQuota":
+		service.CPUQuota, err = strconv.Atoi(strings.TrimSuffix(v, "%"))
+	case "MemoryMax":
+		service.MemoryMax = configuration.Memory(v)
+	case "TasksMax":
+		service.TasksMax, err = strconv.Atoi(v)
+	case "IOWeight":
+		service.IOWeight, err = strconv.Atoi(v)
+	case "IOReadBandwidthMax":
+		var bw string
+		bw, err = unescapeSpecifiers(v)
+		service.IOReadBandwidthMax = append(service.IOReadBandwidthMax, configuration.IOBandwidth(bw))
+	case "IOWriteBandwidthMax":
+		var bw string
+		bw, err = unescapeSpecifiers(v)
+		service.IOWriteBandwidthMax = append(service.IOWriteBandwidthMax, configuration.IOBandwidth(bw))
+	case "LimitNOFILE":
+		service.LimitNOFILE = v
+	case "CPUAffinity":
+		service.CPUAffinity = v
+	case "SecureBits":
+		service.SecureBits = append(service.SecureBits, configuration.SecureBits(v))
+	case "SocketBindAllow":
+		service.SocketBindAllow = append(service.SocketBindAllow, configuration.BindRule(v))
+	case "SocketBindDeny":
+		service.SocketBindDeny = append(service.SocketBindDeny, configuration.BindRule(v))
+	case "KillMode":
+		service.KillMode = configuration.KillMode(v)
+	case "KillSignal":
+		service.KillSignal = configuration.KillSignal(v)
+	case "TimeoutStopSec":
+		service.TimeoutStopSec, err = parseTimespan(v)
+	case "Slice":
+		service.Slice, err = unescapeSpecifiers(v)
+	default:
+		return fmt.Errorf("unsupported key")
+	}
+
+	return err
+}
+
+// unescapeSpecifiers reverts escapeSpecifiers. Any other specifier would be expanded by systemd and can therefore
+// not be represented by the declaration.
+func unescapeSpecifiers(s string) (string, error) {
+	if !strings.Contains(s, "%") {
+		return s, nil
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			sb.WriteByte(s[i])
+			continue
+		}
+
+		if i+1 >= len(s) || s[i+1] != '%' {
+			return "", fmt.Errorf("unsupported specifier in %q", s)
+		}
+
+		sb.WriteByte('%')
+		i++
+	}
+
+	return sb.String(), nil
+}
+
+func parseBoolean(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "yes", "true", "on", "1":
+		return true, nil
+	case "no", "false", "off", "0":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid boolean: %q", s)
+	}
+}
+
+// parseTimespan parses the subset of systemd.time(7) which is emitted by formatTimespan.
+func parseTimespan(s string) (time.Duration, error) {
+	units := []struct {
+		suffix string
+		unit   time.Duration
+	}{
+		{"us", time.Microsecond},
+		{"ms", time.Millisecond},
+		{"s", time.Second},
+	}
+
+	for _, u := range units {
+		if num, ok := strings.CutSuffix(s, u.suffix); ok {
+			n, err := strconv.ParseInt(num, 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid time span: %q", s)
+			}
+
+			return time.Duration(n) * u.unit, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unsupported time span: %q", s)
+}
+
+// parseCommand splits a command line into its unquoted and unescaped words.
+func parseCommand(s string) (configuration.Command, error) {
+	words, err := splitWords(s)
+	if err != nil {
+		return configuration.Command{}, err
+	}
+
+	if len(words) == 0 {
+		return configuration.Command{}, nil
+	}
+
+	for i, word := range words {
+		word, err := unescapeSpecifiers(word)
+		if err != nil {
+			return configuration.Command{}, err
+		}
+
+		words[i] = strings.ReplaceAll(word, "$$", "$")
+	}
+
+	cmd := configuration.Command{Cmd: words[0]}
+	if len(words) > 1 {
+		cmd.Args = words[1:]
+	}
+
+	return cmd, nil
+}
+
+// appendCommand parses another line of a command list like ExecStartPre. An empty line resets the list.
+func appendCommand(cmds []configuration.Command, s string) ([]configuration.Command, error) {
+	cmd, err := parseCommand(s)
+	if err != nil {
+		return cmds, err
+	}
+
+	if cmd.Cmd == "" {
+		return nil, nil
+	}
+
+	return append(cmds, cmd), nil
+}
+
+// parseEnvironment splits an Environment= value into its assignments.
+func parseEnvironment(s string) ([]configuration.EnvVar, error) {
+	words, err := splitWords(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var vars []configuration.EnvVar
+	for _, word := range words {
+		word, err := unescapeSpecifiers(word)
+		if err != nil {
+			return nil, err
+		}
+
+		key, value, ok := strings.Cut(word, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid assignment: %q", word)
+		}
+
+		vars = append(vars, configuration.EnvVar{Key: key, Value: value})
+	}
+
+	return vars, nil
+}
+
+// splitWords splits at whitespace, honors single and double quotes and resolves C-style escapes.
+func splitWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == 0 && (c == ' ' || c == '\t'):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+			inWord = true
+		case quote != 0 && c == quote:
+			quote = 0
+		case c == '\\':
+			if i+1 >= len(s) {
+				return nil, fmt.Errorf("dangling escape in %q", s)
+			}
+
+			i++
+			switch s[i] {
+			case 'n':
+				word.WriteByte('\n')
+			case 't':
+				word.WriteByte('\t')
+			case 'r':
+				word.WriteByte('\r')
+			case 'x':
+				if i+2 >= len(s) {
+					return nil, fmt.Errorf("invalid hex escape in %q", s)
+				}
+
+				b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+				if err != nil {
+					return nil, fmt.Errorf("invalid hex escape in %q", s)
+				}
+
+				word.WriteByte(byte(b))
+				i += 2
+			default:
+				word.WriteByte(s[i])
+			}
+
+			inWord = true
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
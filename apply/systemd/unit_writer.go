@@ -0,0 +1,411 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package systemd
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/worldiety/nago-runner/configuration"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unitWriter renders systemd unit files and applies the quoting and escaping rules of systemd.syntax(7). The first
+// error is kept and returned by bytes, so that a sequence of writes does not need to be checked individually.
+type unitWriter struct {
+	buf      bytes.Buffer
+	sections int
+	err      error
+}
+
+func (w *unitWriter) fail(key string, format string, args ...any) {
+	if w.err == nil {
+		w.err = fmt.Errorf("invalid value for %s: %s", key, fmt.Sprintf(format, args...))
+	}
+}
+
+// comment writes a comment line, which is ignored by systemd.
+func (w *unitWriter) comment(line string) {
+	if strings.ContainsAny(line, "\r\n") {
+		w.fail("comment", "must not contain line breaks")
+		return
+	}
+
+	w.buf.WriteString("# " + line + "\n")
+}
+
+// section starts a new section like [Service].
+func (w *unitWriter) section(name string) {
+	if w.sections > 0 || w.buf.Len() > 0 {
+		w.buf.WriteString("\n")
+	}
+
+	w.sections++
+	w.buf.WriteString("[" + name + "]\n")
+}
+
+// reset writes an empty assignment, which clears a list setting like StateDirectory= of the unit or of an earlier
+// drop-in.
+func (w *unitWriter) reset(key string) {
+	w.buf.WriteString(key + "=\n")
+}
+
+// raw writes the value as is, which is only correct for values which are not subject to specifier expansion,
+// like enums, numbers or sizes. Empty values are omitted.
+func (w *unitWriter) raw(key, value string) {
+	if value == "" {
+		return
+	}
+
+	if !w.plain(key, value) {
+		return
+	}
+
+	w.buf.WriteString(key + "=" + value + "\n")
+}
+
+// text writes a value which is subject to specifier expansion, thus any % is escaped. Empty values are omitted.
+func (w *unitWriter) text(key, value string) {
+	if value == "" {
+		return
+	}
+
+	if !w.plain(key, value) {
+		return
+	}
+
+	w.buf.WriteString(key + "=" + escapeSpecifiers(value) + "\n")
+}
+
+// plain checks that the value can be represented unquoted on a single line.
+func (w *unitWriter) plain(key, value string) bool {
+	if strings.IndexFunc(value, isControl) >= 0 {
+		w.fail(key, "must not contain control characters: %q", value)
+		return false
+	}
+
+	if strings.HasSuffix(value, "\\") {
+		w.fail(key, "must not end with a backslash: %q", value)
+		return false
+	}
+
+	if strings.TrimSpace(value) != value {
+		w.fail(key, "must not contain leading or trailing whitespace: %q", value)
+		return false
+	}
+
+	return true
+}
+
+// boolean writes yes if set, otherwise the key is omitted and the systemd default applies.
+func (w *unitWriter) boolean(key string, value bool) {
+	if value {
+		w.buf.WriteString(key + "=yes\n")
+	}
+}
+
+// integer writes the value if it is not 0.
+func (w *unitWriter) integer(key string, value int) {
+	if value != 0 {
+		w.buf.WriteString(key + "=" + strconv.Itoa(value) + "\n")
+	}
+}
+
+// duration writes the value as a systemd time span if it is not 0.
+func (w *unitWriter) duration(key string, value time.Duration) {
+	if value != 0 {
+		w.buf.WriteString(key + "=" + formatTimespan(value) + "\n")
+	}
+}
+
+// command writes a command line, where each word is quoted if required and specifiers and variables are
+// escaped. A command without Cmd is omitted.
+func (w *unitWriter) command(key string, cmd configuration.Command) {
+	if cmd.Cmd == "" {
+		return
+	}
+
+	words := make([]string, 0, len(cmd.Args)+1)
+	for _, word := range append([]string{cmd.Cmd}, cmd.Args...) {
+		words = append(words, quoteWord(strings.ReplaceAll(escapeSpecifiers(word), "$", "$$"), false))
+	}
+
+	w.buf.WriteString(key + "=" + strings.Join(words, " ") + "\n")
+}
+
+// commands writes each command on its own line, which systemd executes one after another. In contrast to a
+// single command, an entry without Cmd cannot be omitted without changing the meaning.
+func (w *unitWriter) commands(key string, cmds []configuration.Command) {
+	for _, cmd := range cmds {
+		if cmd.Cmd == "" {
+			w.fail(key, "command must not be empty")
+			return
+		}
+
+		w.command(key, cmd)
+	}
+}
+
+// env writes each variable as a quoted assignment on its own line.
+func (w *unitWriter) env(key string, vars []configuration.EnvVar) {
+	for _, v := range vars {
+		if v.Key == "" || strings.ContainsAny(v.Key, "= \t") || strings.IndexFunc(v.Key, isControl) >= 0 {
+			w.fail(key, "invalid variable name: %q", v.Key)
+			return
+		}
+
+		w.buf.WriteString(key + "=" + quoteWord(escapeSpecifiers(v.Key+"="+v.Value), true) + "\n")
+	}
+}
+
+func (w *unitWriter) bytes() ([]byte, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+
+	return w.buf.Bytes(), nil
+}
+
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
+
+func escapeSpecifiers(s string) string {
+	return strings.ReplaceAll(s, "%", "%%")
+}
+
+// quoteWord returns the word as is, if possible, or puts it into double quotes and applies C-style escapes.
+func quoteWord(word string, always bool) string {
+	if !always && word != "" && !strings.ContainsAny(word, " \t\"'\\;") && strings.IndexFunc(word, isControl) < 0 {
+		return word
+	}
+
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range word {
+		switch r {
+		case '"':
+			sb.WriteString(`\"`)
+		case '\\':
+			sb.WriteString(`\\`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case '\r':
+			sb.WriteString(`\r`)
+		default:
+			if isControl(r) {
+				sb.WriteString(fmt.Sprintf(`\x%02x`, r))
+			} else {
+				sb.WriteRune(r)
+			}
+		}
+	}
+	sb.WriteByte('"')
+
+	return sb.String()
+}
+
+// formatTimespan renders a duration in the largest unit without loss of precision.
+func formatTimespan(d time.Duration) string {
+	switch {
+	case d%time.Second == 0:
+		return strconv.FormatInt(int64(d/time.Second), 10) + "s"
+	case d%time.Millisecond == 0:
+		return strconv.FormatInt(int64(d/time.Millisecond), 10) + "ms"
+	default:
+		return strconv.FormatInt(int64(d/time.Microsecond), 10) + "us"
+	}
+}
+
+// renderServiceUnit writes the [Unit], [Service] and [Install] sections of the given declaration.
+func renderServiceUnit(w *unitWriter, unit configuration.ServiceUnit) {
+	w.section("Unit")
+	w.text("Description", unit.Unit.Description)
+	w.text("After", string(unit.Unit.After))
+	for _, name := range unit.Unit.AfterUnits {
+		w.text("After", string(name))
+	}
+
+	for _, name := range unit.Unit.Requires {
+		w.text("Requires", string(name))
+	}
+
+	for _, name := range unit.Unit.Wants {
+		w.text("Wants", string(name))
+	}
+
+	for _, name := range unit.Unit.BindsTo {
+		w.text("BindsTo", string(name))
+	}
+
+	w.section("Service")
+	renderServiceSection(w, unit.Service)
+
+	w.section("Install")
+	w.text("WantedBy", unit.Install.WantedBy)
+}
+
+// renderServiceSection writes all fields of the service section in a fixed order, thus an unchanged declaration
+// always renders the same content.
+func renderServiceSection(w *unitWriter, service configuration.ServiceSection) {
+	w.raw("Type", string(service.Type))
+	w.text("User", service.User)
+	w.text("Group", service.Group)
+	w.text("BindPaths", service.BindPaths)
+	w.text("BindReadOnlyPaths", service.BindReadOnlyPaths)
+	w.text("ReadOnlyPaths", service.ReadOnlyPaths)
+	w.text("ReadWritePaths", service.ReadWritePaths)
+	w.text("InaccessiblePaths", service.InaccessiblePaths)
+	w.text("ExecPaths", service.ExecPaths)
+	w.text("AppArmorProfile", service.AppArmorProfile)
+	w.text("StateDirectory", service.StateDirectory)
+	w.raw("SystemCallFilter", service.SystemCallFilter)
+	w.boolean("PrivateTmp", service.PrivateTmp)
+	w.boolean("MemoryDenyWriteExecute", service.MemoryDenyWriteExecute)
+	w.boolean("DynamicUser", service.DynamicUser)
+	w.boolean("RemoveIPC", service.RemoveIPC)
+	w.boolean("NoNewPrivileges", service.NoNewPrivileges)
+	w.boolean("PrivateDevices", service.PrivateDevices)
+	w.boolean("PrivateIPC", service.PrivateIPC)
+	w.boolean("PrivatePIDs", service.PrivatePIDs)
+	w.boolean("PrivateMounts", service.PrivateMounts)
+	w.boolean("PrivateNetwork", service.PrivateNetwork)
+	w.raw("PrivateUsers", string(service.PrivateUsers))
+	w.boolean("ProtectKernelModules", service.ProtectKernelModules)
+	w.boolean("ProtectKernelTunables", service.ProtectKernelTunables)
+	w.boolean("ProtectClock", service.ProtectClock)
+	w.boolean("ProtectKernelLogs", service.ProtectKernelLogs)
+	w.boolean("ProtectHostname", service.ProtectHostname)
+	w.boolean("SetLoginEnvironment", service.SetLoginEnvironment)
+	w.boolean("RestrictSUIDSGID", service.RestrictSUIDSGID)
+	w.boolean("RestrictRealtime", service.RestrictRealtime)
+	for _, ns := range service.RestrictNamespaces {
+		w.raw("RestrictNamespaces", string(ns))
+	}
+
+	w.raw("ProtectHome", string(service.ProtectHome))
+	w.raw("ProtectSystem", string(service.ProtectSystem))
+	w.raw("ProtectControlGroups", string(service.ProtectControlGroups))
+	w.raw("ProtectProc", string(service.ProtectProc))
+	w.commands("ExecStartPre", service.ExecStartPre)
+	w.command("ExecStart", service.ExecStart)
+	w.commands("ExecStartPost", service.ExecStartPost)
+	w.commands("ExecStop", service.ExecStop)
+	w.commands("ExecReload", service.ExecReload)
+	w.env("Environment", service.Environment)
+	for _, file := range service.EnvironmentFile {
+		// specifiers are intended here, e.g. the instance %i of a template
+		w.raw("EnvironmentFile", file)
+	}
+
+	for _, cred := range service.LoadCredential {
+		w.text("LoadCredential", cred)
+	}
+
+	for _, cred := range service.LoadCredentialEncrypted {
+		w.text("LoadCredentialEncrypted", cred)
+	}
+
+	for _, c := range service.CapabilityBoundingSet {
+		w.raw("CapabilityBoundingSet", string(c))
+	}
+
+	w.raw("Restart", string(service.Restart))
+	w.duration("RestartSec", service.RestartSec)
+	w.raw("MemoryHigh", string(service.MemoryHigh))
+	w.raw("MemorySwapMax", string(service.MemorySwapMax))
+	w.raw("StartupMemoryHigh", string(service.StartupMemoryHigh))
+	w.raw("StartupMemorySwapMax", string(service.StartupMemorySwapMax))
+	w.raw("OOMPolicy", string(service.OOMPolicy))
+	w.integer("OOMScoreAdjust", service.OOMScoreAdjust)
+	w.integer("CPUWeight", service.CPUWeight)
+	if service.CPUQuota != 0 {
+		w.raw("CPUQuota", strconv.Itoa(service.CPUQuota)+"%")
+	}
+
+	w.raw("MemoryMax", string(service.MemoryMax))
+	w.integer("TasksMax", service.TasksMax)
+	w.integer("IOWeight", service.IOWeight)
+	for _, bw := range service.IOReadBandwidthMax {
+		w.text("IOReadBandwidthMax", string(bw))
+	}
+
+	for _, bw := range service.IOWriteBandwidthMax {
+		w.text("IOWriteBandwidthMax", string(bw))
+	}
+
+	w.raw("LimitNOFILE", service.LimitNOFILE)
+	w.raw("CPUAffinity", service.CPUAffinity)
+
+	for _, sec := range service.SecureBits {
+		w.raw("SecureBits", string(sec))
+	}
+
+	for _, rule := range service.SocketBindAllow {
+		w.raw("SocketBindAllow", string(rule))
+	}
+
+	for _, rule := range service.SocketBindDeny {
+		w.raw("SocketBindDeny", string(rule))
+	}
+
+	w.raw("KillMode", string(service.KillMode))
+	w.raw("KillSignal", string(service.KillSignal))
+	w.duration("TimeoutStopSec", service.TimeoutStopSec)
+	w.text("Slice", service.Slice)
+}
+
+// renderTimerUnit writes a timer which triggers the service of the same name.
+func renderTimerUnit(w *unitWriter, description string, job configuration.Job) {
+	w.section("Unit")
+	w.text("Description", description)
+
+	w.section("Timer")
+	w.raw("OnCalendar", job.OnCalendar)
+	w.boolean("Persistent", job.Persistent)
+	w.duration("RandomizedDelaySec", job.RandomizedDelay)
+
+	w.section("Install")
+	w.text("WantedBy", "timers.target")
+}
+
+// renderSocketUnit writes a socket, which activates the service of the same name.
+func renderSocketUnit(w *unitWriter, description string, socket configuration.Socket) {
+	w.section("Unit")
+	w.text("Description", description)
+
+	w.section("Socket")
+	for _, listen := range socket.ListenStream {
+		w.text("ListenStream", listen)
+	}
+
+	for _, listen := range socket.ListenDatagram {
+		w.text("ListenDatagram", listen)
+	}
+
+	w.section("Install")
+	w.text("WantedBy", "sockets.target")
+}
+
+// renderSliceUnit writes a slice with its resource limits.
+func renderSliceUnit(w *unitWriter, description string, slice configuration.Slice) {
+	w.section("Unit")
+	w.text("Description", description)
+
+	w.section("Slice")
+	w.raw("MemoryMax", string(slice.MemoryMax))
+	if slice.CPUQuota != 0 {
+		w.raw("CPUQuota", strconv.Itoa(slice.CPUQuota)+"%")
+	}
+
+	w.integer("IOWeight", slice.IOWeight)
+	w.integer("TasksMax", slice.TasksMax)
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package systemd
+
+import (
+	"github.com/worldiety/nago-runner/configuration"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRenderServiceUnitRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  configuration.Command
+		env  []configuration.EnvVar
+		want string
+	}{
+		{
+			name: "percent",
+			cmd:  configuration.Command{Cmd: "/opt/ngr/app", Args: []string{"--rate=100%"}},
+			want: "ExecStart=/opt/ngr/app --rate=100%%\n",
+		},
+		{
+			name: "dollar",
+			cmd:  configuration.Command{Cmd: "/opt/ngr/app", Args: []string{"$HOME", "${USER}"}},
+			want: "ExecStart=/opt/ngr/app $$HOME $${USER}\n",
+		},
+		{
+			name: "double quotes",
+			cmd:  configuration.Command{Cmd: "/opt/ngr/app", Args: []string{`say "hi"`}},
+			want: `ExecStart=/opt/ngr/app "say \"hi\""` + "\n",
+		},
+		{
+			name: "single quote",
+			cmd:  configuration.Command{Cmd: "/opt/ngr/app", Args: []string{"it's"}},
+			want: `ExecStart=/opt/ngr/app "it's"` + "\n",
+		},
+		{
+			name: "spaces",
+			cmd:  configuration.Command{Cmd: "/opt/ngr/my app", Args: []string{"a b", ""}},
+			want: `ExecStart="/opt/ngr/my app" "a b" ""` + "\n",
+		},
+		{
+			name: "newline and backslash",
+			cmd:  configuration.Command{Cmd: "/opt/ngr/app", Args: []string{"a\nb", `c:\d`}},
+			want: `ExecStart=/opt/ngr/app "a\nb" "c:\\d"` + "\n",
+		},
+		{
+			name: "environment with quotes, percent and dollar",
+			cmd:  configuration.Command{Cmd: "/opt/ngr/app"},
+			env:  []configuration.EnvVar{{Key: "GREETING", Value: `hello "world" 100% $HOME`}},
+			want: `Environment="GREETING=hello \"world\" 100%% $HOME"` + "\n",
+		},
+		{
+			name: "environment with spaces and newline",
+			cmd:  configuration.Command{Cmd: "/opt/ngr/app"},
+			env:  []configuration.EnvVar{{Key: "MULTI", Value: " line1\nline2 "}},
+			want: `Environment="MULTI= line1\nline2 "` + "\n",
+		},
+		{
+			name: "empty environment value",
+			cmd:  configuration.Command{Cmd: "/opt/ngr/app"},
+			env:  []configuration.EnvVar{{Key: "EMPTY"}},
+			want: `Environment="EMPTY="` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var unit configuration.ServiceUnit
+			unit.Service.ExecStart = tt.cmd
+			unit.Service.Environment = tt.env
+
+			var w unitWriter
+			renderServiceUnit(&w, unit)
+			buf, err := w.bytes()
+			if err != nil {
+				t.Fatalf("render: %v", err)
+			}
+
+			if !strings.Contains(string(buf), "\n"+tt.want) {
+				t.Fatalf("expected line %q in:\n%s", tt.want, buf)
+			}
+
+			parsed, err := ParseUnit(buf)
+			if err != nil {
+				t.Fatalf("parse: %v\n%s", err, buf)
+			}
+
+			if got, want := normalizeUnit(parsed), normalizeUnit(unit); !reflect.DeepEqual(got, want) {
+				t.Fatalf("round-trip mismatch:\ngot  %#v\nwant %#v", got.Service, want.Service)
+			}
+		})
+	}
+}
+
+func TestRenderServiceUnitRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		unit configuration.ServiceUnit
+	}{
+		{
+			name: "variable name with equal sign",
+			unit: configuration.ServiceUnit{Service: configuration.ServiceSection{
+				Environment: []configuration.EnvVar{{Key: "A=B", Value: "c"}},
+			}},
+		},
+		{
+			name: "variable name with space",
+			unit: configuration.ServiceUnit{Service: configuration.ServiceSection{
+				Environment: []configuration.EnvVar{{Key: "A B", Value: "c"}},
+			}},
+		},
+		{
+			name: "user with line break",
+			unit: configuration.ServiceUnit{Service: configuration.ServiceSection{User: "root\nExecStart=/bin/sh"}},
+		},
+		{
+			name: "empty command in list",
+			unit: configuration.ServiceUnit{Service: configuration.ServiceSection{
+				ExecStartPre: []configuration.Command{{Cmd: ""}},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w unitWriter
+			renderServiceUnit(&w, tt.unit)
+			if buf, err := w.bytes(); err == nil {
+				t.Fatalf("expected an error, got:\n%s", buf)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package systemd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/worldiety/nago-runner/configuration"
+	"github.com/worldiety/nago-runner/setup"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// artifactLayout describes the versioned installation of a FileSet:
+//
+//	/opt/ngr/<inst>                   -> <inst>.d/current/<executable path>
+//	/opt/ngr/<inst>.d/current         -> <version>
+//	/opt/ngr/<inst>.d/previous        -> <version>
+//	/opt/ngr/<inst>.d/<version>/...   all declared files
+//
+// Switching the current link is atomic, thus a service never sees a partially installed FileSet.
+type artifactLayout struct {
+	paths Paths
+	dir   string
+}
+
+func newArtifactLayout(instID string) artifactLayout {
+	paths := NewService(instID).Paths()
+	return artifactLayout{paths: paths, dir: paths.ExecFilename + ".d"}
+}
+
+func (l artifactLayout) current() string {
+	return filepath.Join(l.dir, "current")
+}
+
+func (l artifactLayout) previous() string {
+	return filepath.Join(l.dir, "previous")
+}
+
+// usesArtifacts returns true, if the application declares a FileSet instead of a single executable.
+func usesArtifacts(cfg configuration.Application) bool {
+	return len(cfg.Artifacts.FileSet.Files) > 0
+}
+
+// artifactVersion returns the directory name of the given FileSet.
+func artifactVersion(set configuration.FileSet) string {
+	v := string(set.Hash)
+	if len(v) > 32 {
+		v = v[:32]
+	}
+
+	return v
+}
+
+// artifactsPending returns true, if the declared FileSet is not the current one.
+func artifactsPending(cfg configuration.Application) bool {
+	layout := newArtifactLayout(cfg.InstID)
+	current, _ := os.Readlink(layout.current())
+	return current != artifactVersion(cfg.Artifacts.FileSet)
+}
+
+// updateArtifacts materializes the declared FileSet into a new versioned directory, verifies every file and the
+// aggregated hash and switches the current version atomically. Only the current and the previous version are
+// kept. It returns false and no error, if the declared version is already installed and intact.
+func updateArtifacts(logger *slog.Logger, settings setup.Settings, cfg configuration.Application) (bool, error) {
+	if !configuration.Name(cfg.InstID).Valid() {
+		return false, fmt.Errorf("invalid systemd unit name: %s", cfg.InstID)
+	}
+
+	set := cfg.Artifacts.FileSet
+	exe, ok := set.Executable()
+	if !ok {
+		return false, errors.New("artifacts do not contain an executable file")
+	}
+
+	for _, file := range set.Files {
+		if err := file.Path.Validate(); err != nil {
+			return false, fmt.Errorf("invalid artifact path: %s: %w", file.Path, err)
+		}
+	}
+
+	if hash := set.ComputeHash(); hash != set.Hash {
+		return false, fmt.Errorf("artifacts hash mismatch: got %s, want %s", hash, set.Hash)
+	}
+
+	layout := newArtifactLayout(cfg.InstID)
+	version := artifactVersion(set)
+	versionDir := filepath.Join(layout.dir, version)
+	execTarget := filepath.Join(filepath.Base(layout.dir), "current", artifactPath(exe.Path))
+
+	if !artifactsPending(cfg) {
+		err := verifyArtifacts(versionDir, set)
+		if err == nil {
+			// repair the entry point, just in case
+			if err := replaceSymlink(execTarget, layout.paths.ExecFilename); err != nil {
+				return false, err
+			}
+
+			logger.Info("artifacts are unchanged", "version", version)
+			return false, nil
+		}
+
+		logger.Warn("installed artifacts are damaged, reinstalling", "version", version, "err", err.Error())
+	}
+
+	staging := versionDir + ".tmp"
+	if err := os.RemoveAll(staging); err != nil {
+		return false, fmt.Errorf("cannot clean staging dir: %w", err)
+	}
+
+	for _, file := range set.Files {
+		blob, err := fetchBlob(logger, settings, file.URL, file.Size, file.Hash)
+		if err != nil {
+			return false, fmt.Errorf("cannot download artifact: %s: %w", file.Path, err)
+		}
+
+		mode := os.FileMode(0644)
+		if file.Executable {
+			mode = 0755
+		}
+
+		dst := filepath.Join(staging, artifactPath(file.Path))
+		if err := installBlob(blob, dst, mode); err != nil {
+			return false, fmt.Errorf("cannot install artifact: %s: %w", file.Path, err)
+		}
+	}
+
+	if err := os.RemoveAll(versionDir); err != nil {
+		return false, fmt.Errorf("cannot remove damaged version: %w", err)
+	}
+
+	if err := os.Rename(staging, versionDir); err != nil {
+		return false, fmt.Errorf("cannot commit version dir: %w", err)
+	}
+
+	if current, err := os.Readlink(layout.current()); err == nil && current != version {
+		if err := replaceSymlink(current, layout.previous()); err != nil {
+			return false, err
+		}
+	}
+
+	if err := replaceSymlink(version, layout.current()); err != nil {
+		return false, err
+	}
+
+	// a former single executable is kept for a rollback, our own symlinks are not
+	if stat, err := os.Lstat(layout.paths.ExecFilename); err == nil && stat.Mode().IsRegular() {
+		if err := keepPrevious(layout.paths.ExecFilename); err != nil {
+			return false, err
+		}
+	}
+
+	if err := replaceSymlink(execTarget, layout.paths.ExecFilename); err != nil {
+		return false, err
+	}
+
+	if err := removeStaleVersions(logger, layout); err != nil {
+		return false, err
+	}
+
+	logger.Info("artifacts installed", "version", version, "files", len(set.Files))
+	return true, nil
+}
+
+// restorePreviousArtifacts switches the current version back to the previous one. It returns false, if there
+// was no previous version.
+func restorePreviousArtifacts(instID string) (bool, error) {
+	layout := newArtifactLayout(instID)
+	prev, err := os.Readlink(layout.previous())
+	if err != nil {
+		return false, nil
+	}
+
+	if err := replaceSymlink(prev, layout.current()); err != nil {
+		return false, err
+	}
+
+	if err := os.Remove(layout.previous()); err != nil {
+		return false, fmt.Errorf("cannot remove previous link: %w", err)
+	}
+
+	return true, nil
+}
+
+// verifyArtifacts checks that every declared file is present with the declared size and hash.
+func verifyArtifacts(versionDir string, set configuration.FileSet) error {
+	for _, file := range set.Files {
+		fname := filepath.Join(versionDir, artifactPath(file.Path))
+		stat, err := os.Stat(fname)
+		if err != nil {
+			return err
+		}
+
+		if stat.Size() != file.Size {
+			return fmt.Errorf("size mismatch: %s", fname)
+		}
+
+		hash, err := cachedSha3(fname)
+		if err != nil {
+			return err
+		}
+
+		if hash != file.Hash {
+			return fmt.Errorf("hash mismatch: %s", fname)
+		}
+	}
+
+	return nil
+}
+
+// removeStaleVersions deletes everything in the artifact directory, which is neither the current nor the
+// previous version.
+func removeStaleVersions(logger *slog.Logger, layout artifactLayout) error {
+	current, _ := os.Readlink(layout.current())
+	previous, _ := os.Readlink(layout.previous())
+
+	entries, err := os.ReadDir(layout.dir)
+	if err != nil {
+		return fmt.Errorf("cannot read artifacts dir: %w", err)
+	}
+
+	for _, entry := range entries {
+		switch entry.Name() {
+		case "current", "previous", current, previous:
+			continue
+		}
+
+		logger.Info("removing stale artifacts", "file", entry.Name())
+		if err := os.RemoveAll(filepath.Join(layout.dir, entry.Name())); err != nil {
+			return fmt.Errorf("cannot remove stale artifacts: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// artifactPath converts the declared sandbox path into a relative os path.
+func artifactPath(p configuration.Path) string {
+	return filepath.FromSlash(strings.TrimPrefix(string(p), "/"))
+}
+
+// replaceSymlink atomically creates or replaces the link with a symlink to the target.
+func replaceSymlink(target, link string) error {
+	if current, err := os.Readlink(link); err == nil && current == target {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+		return fmt.Errorf("cannot create link parent: %w", err)
+	}
+
+	tmp := link + ".tmp"
+	_ = os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return fmt.Errorf("cannot create symlink: %s: %w", link, err)
+	}
+
+	if err := os.Rename(tmp, link); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("cannot replace symlink: %s: %w", link, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,298 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package systemd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/worldiety/nago-runner/configuration"
+	"github.com/worldiety/nago-runner/pkg/linux"
+	"github.com/worldiety/nago-runner/service/event"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const buildDir = "/var/cache/ngr/build"
+
+// buildState is persisted after each successful installation of a build output.
+type buildState struct {
+	Commit string                 `json:"commit"`
+	Hash   configuration.Sha3V512 `json:"hash"`
+}
+
+// buildWorkspace is the isolated build directory of a single instance.
+type buildWorkspace struct {
+	dir string
+}
+
+func newBuildWorkspace(instID string) buildWorkspace {
+	return buildWorkspace{dir: filepath.Join(buildDir, instID)}
+}
+
+func (w buildWorkspace) srcDir() string {
+	return filepath.Join(w.dir, "src")
+}
+
+func (w buildWorkspace) stateFile() string {
+	return filepath.Join(w.dir, "build.json")
+}
+
+// env returns an environment which uses the ssh key and the known hosts in the given directory for git and keeps
+// the go caches inside the workspace.
+func (w buildWorkspace) env(sshDir string) []string {
+	env := slices.Clone(os.Environ())
+	env = append(env,
+		"GIT_SSH_COMMAND=ssh -i "+filepath.Join(sshDir, "id_key")+" -o IdentitiesOnly=yes -o StrictHostKeyChecking=yes -o UserKnownHostsFile="+filepath.Join(sshDir, "known_hosts"),
+		"GIT_TERMINAL_PROMPT=0",
+		"HOME="+w.dir,
+		"GOPATH="+filepath.Join(w.dir, "gopath"),
+		"GOCACHE="+filepath.Join(w.dir, "gocache"),
+		"CGO_ENABLED=0",
+	)
+
+	return env
+}
+
+func (w buildWorkspace) prepare() error {
+	if err := os.MkdirAll(w.dir, 0700); err != nil {
+		return fmt.Errorf("cannot create build directory: %w", err)
+	}
+
+	// former runner versions kept the key in the workspace
+	if err := os.Remove(filepath.Join(w.dir, "id_key")); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove persisted ssh key: %w", err)
+	}
+
+	return nil
+}
+
+// run executes the command with the declared ssh key and known hosts, which only exist during the call, because
+// the key must not persist on disk.
+func (w buildWorkspace) run(git configuration.Git, dir string, name string, args ...string) (string, error) {
+	sshDir, err := os.MkdirTemp("", "ngr-ssh-")
+	if err != nil {
+		return "", fmt.Errorf("cannot create ssh directory: %w", err)
+	}
+
+	defer os.RemoveAll(sshDir)
+
+	key := git.SSHPrivateKey
+	if key != "" && !strings.HasSuffix(key, "\n") {
+		// ssh refuses to load keys without a trailing line break
+		key += "\n"
+	}
+
+	if err := os.WriteFile(filepath.Join(sshDir, "id_key"), []byte(key), 0600); err != nil {
+		return "", fmt.Errorf("cannot write ssh key: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(sshDir, "known_hosts"), []byte(git.KnownHosts), 0600); err != nil {
+		return "", fmt.Errorf("cannot write known hosts: %w", err)
+	}
+
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	cmd.Env = w.env(sshDir)
+	buf, err := cmd.CombinedOutput()
+	if err != nil {
+		return string(buf), fmt.Errorf("%s %s failed: %w: %s", name, strings.Join(args, " "), err, string(buf))
+	}
+
+	return strings.TrimSpace(string(buf)), nil
+}
+
+func (w buildWorkspace) loadState() buildState {
+	var state buildState
+	buf, err := os.ReadFile(w.stateFile())
+	if err != nil {
+		return state
+	}
+
+	if err := json.Unmarshal(buf, &state); err != nil {
+		slog.Error("cannot parse build state", "file", w.stateFile(), "err", err.Error())
+	}
+
+	return state
+}
+
+// checkout clones the repository or updates an existing clone to the head of the declared branch and
+// returns the checked out commit. An existing clone of another repository is replaced.
+func (w buildWorkspace) checkout(git configuration.Git) (string, error) {
+	src := w.srcDir()
+	if _, err := os.Stat(filepath.Join(src, ".git")); err == nil {
+		if url, err := w.run(git, src, "git", "remote", "get-url", "origin"); err != nil || url != git.URL {
+			slog.Info("repository has changed, cloning again", "dir", src, "url", git.URL)
+			if err := os.RemoveAll(src); err != nil {
+				return "", fmt.Errorf("cannot remove former clone: %w", err)
+			}
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(src, ".git")); os.IsNotExist(err) {
+		_ = os.RemoveAll(src)
+		args := []string{"clone", "--depth", "1", "--single-branch"}
+		if git.Branch != "" {
+			args = append(args, "--branch", git.Branch)
+		}
+
+		args = append(args, "--", git.URL, src)
+		if _, err := w.run(git, w.dir, "git", args...); err != nil {
+			return "", err
+		}
+	} else {
+		ref := git.Branch
+		if ref == "" {
+			ref = "HEAD"
+		}
+
+		if _, err := w.run(git, src, "git", "fetch", "--depth", "1", "--", "origin", ref); err != nil {
+			return "", err
+		}
+
+		if _, err := w.run(git, src, "git", "reset", "--hard", "FETCH_HEAD"); err != nil {
+			return "", err
+		}
+
+		if _, err := w.run(git, src, "git", "clean", "-ffdx"); err != nil {
+			return "", err
+		}
+	}
+
+	return w.run(git, src, "git", "rev-parse", "HEAD")
+}
+
+// buildExecutable checks out the declared git repository and performs a cgo-free go build of the declared main
+// package. The output is installed as the instance executable through the same code path as updateExecutable.
+// It returns false and no error, if the installed executable already matches the head of the branch. The outcome
+// of every build is published on the bus.
+func buildExecutable(logger *slog.Logger, bus event.Bus, cfg configuration.Application) (bool, error) {
+	start := time.Now()
+	res, err := buildAndInstall(logger, cfg)
+	res.InstanceID = cfg.InstID
+	res.AppID = cfg.AppID
+	res.Duration = time.Since(start)
+	if err != nil {
+		res.Error = err.Error()
+		logger.Error("build failed", "instance", cfg.InstID, "err", err.Error())
+	}
+
+	bus.Publish(res)
+
+	return res.Installed, err
+}
+
+func buildAndInstall(logger *slog.Logger, cfg configuration.Application) (event.BuildCompleted, error) {
+	var res event.BuildCompleted
+	if !configuration.Name(cfg.InstID).Valid() {
+		return res, fmt.Errorf("invalid systemd unit name: %s", cfg.InstID)
+	}
+
+	if !cfg.Build.PureGo.Enabled || cfg.Build.PureGo.MainPkg == "" {
+		return res, errors.New("unsupported build: only PureGo builds are implemented")
+	}
+
+	ws := newBuildWorkspace(cfg.InstID)
+	if err := ws.prepare(); err != nil {
+		return res, err
+	}
+
+	commit, err := ws.checkout(cfg.Build.Git)
+	if err != nil {
+		return res, fmt.Errorf("cannot checkout repository: %w", err)
+	}
+
+	res.Commit = commit
+
+	paths := NewService(cfg.InstID).Paths()
+	state := ws.loadState()
+	currentHash, err := cachedSha3(paths.ExecFilename)
+	if err != nil {
+		return res, fmt.Errorf("error hashing executable: %s", paths.ExecFilename)
+	}
+
+	if state.Commit == commit && state.Hash == currentHash {
+		logger.Info("build is up to date", "instance", cfg.InstID, "commit", commit)
+		res.Hash = string(currentHash)
+		return res, nil
+	}
+
+	logger.Info("building executable", "instance", cfg.InstID, "commit", commit, "pkg", cfg.Build.PureGo.MainPkg)
+	output := filepath.Join(ws.dir, "out", path.Base(cfg.Build.PureGo.MainPkg))
+	if res.Output, err = ws.run(cfg.Build.Git, ws.srcDir(), "go", "build", "-trimpath", "-o", output, "--", cfg.Build.PureGo.MainPkg); err != nil {
+		return res, err
+	}
+
+	// the build directory may be on a different filesystem, thus copy before the atomic rename
+	tmpFile := paths.ExecFilename + ".tmp"
+	if err := copyFile(output, tmpFile); err != nil {
+		return res, err
+	}
+
+	hash, err := linux.Sha3(tmpFile)
+	if err != nil {
+		return res, fmt.Errorf("error hashing build output: %s", tmpFile)
+	}
+
+	if err := installExecutable(paths, tmpFile); err != nil {
+		return res, err
+	}
+
+	if err := linux.WriteJSON(ws.stateFile(), buildState{Commit: commit, Hash: hash}); err != nil {
+		return res, fmt.Errorf("cannot write build state: %w", err)
+	}
+
+	res.Hash = string(hash)
+	res.Installed = true
+	return res, nil
+}
+
+// buildPending returns true, if the installed executable is not the output of the last build. The remote is not
+// asked for its head, because planning must neither write the ssh key nor access the network, thus a new commit
+// is only noticed by the next apply.
+func buildPending(cfg configuration.Application) (bool, error) {
+	state := newBuildWorkspace(cfg.InstID).loadState()
+	hash, err := peekSha3(NewService(cfg.InstID).Paths().ExecFilename)
+	if err != nil {
+		return false, fmt.Errorf("error hashing executable: %w", err)
+	}
+
+	return state.Commit == "" || state.Hash != hash, nil
+}
+
+func copyFile(src, dst string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("cannot open file: %s: %w", src, err)
+	}
+
+	defer r.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("cannot create parent directory: %s: %w", dst, err)
+	}
+
+	w, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open file: %s: %w", dst, err)
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		_ = w.Close()
+		return fmt.Errorf("cannot copy file: %s: %w", dst, err)
+	}
+
+	return w.Close()
+}
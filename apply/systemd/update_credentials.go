@@ -0,0 +1,351 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package systemd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha3"
+	"encoding/hex"
+	"fmt"
+	"github.com/worldiety/nago-runner/configuration"
+	"github.com/worldiety/nago-runner/pkg/linux"
+	"hash"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	credentialsDir = "/etc/ngr/credentials"
+	// encrypted credentials are not deterministic, thus a keyed hash of the plaintext is kept next to it. The key
+	// never leaves the runner, so that the hash is useless for guessing the plaintext.
+	credentialHashSuffix = ".hmac"
+	credentialKeyFile    = "/etc/ngr/credentials.key"
+	encryptedSuffix      = ".cred"
+)
+
+// systemdCredsAvailable tells if credentials can be encrypted by systemd-creds on this host.
+var systemdCredsAvailable = sync.OnceValues(func() (bool, error) {
+	path, err := linux.Which("systemd-creds")
+	if err != nil {
+		return false, fmt.Errorf("cannot detect systemd-creds: %w", err)
+	}
+
+	return path != "", nil
+})
+
+// credentialStore is the root-only directory which contains the credential files of a single instance.
+type credentialStore struct {
+	dir       string
+	encrypted bool
+}
+
+func newCredentialStore(instID string) (credentialStore, error) {
+	encrypted, err := systemdCredsAvailable()
+	if err != nil {
+		return credentialStore{}, err
+	}
+
+	return credentialStore{dir: filepath.Join(credentialsDir, instID), encrypted: encrypted}, nil
+}
+
+func (s credentialStore) filename(name configuration.Name) string {
+	if s.encrypted {
+		return filepath.Join(s.dir, string(name)+encryptedSuffix)
+	}
+
+	return filepath.Join(s.dir, string(name))
+}
+
+// load returns the LoadCredential= or LoadCredentialEncrypted= value for the given credential.
+func (s credentialStore) load(name configuration.Name) string {
+	return string(name) + ":" + s.filename(name)
+}
+
+// pending returns true, if the stored credential does not match the declared value.
+func (s credentialStore) pending(cred configuration.Credential) (bool, error) {
+	filename := s.filename(cred.Name)
+	if !s.encrypted {
+		expected, err := linux.Sha3Bytes([]byte(cred.Value))
+		if err != nil {
+			return false, err
+		}
+
+		current, err := linux.Sha3(filename)
+		if err != nil {
+			return false, err
+		}
+
+		return current != expected, nil
+	}
+
+	if _, err := os.Stat(filename); err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+
+		return false, err
+	}
+
+	// without a key, no credential has been written yet
+	key, err := credentialKey(false)
+	if err != nil {
+		return false, err
+	}
+
+	if key == nil {
+		return true, nil
+	}
+
+	buf, err := os.ReadFile(filename + credentialHashSuffix)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+
+		return false, err
+	}
+
+	return !hmac.Equal(bytes.TrimSpace(buf), []byte(credentialHash(key, cred.Value))), nil
+}
+
+// write stores the credential atomically with mode 0600.
+func (s credentialStore) write(cred configuration.Credential) error {
+	filename := s.filename(cred.Name)
+	if !s.encrypted {
+		return linux.WriteFile(filename, []byte(cred.Value), 0600)
+	}
+
+	// the plaintext is passed through stdin, so that it never touches the disk
+	tmpFile := filename + ".tmp"
+	cmd := exec.Command("systemd-creds", "encrypt", "--name="+string(cred.Name), "-", tmpFile)
+	cmd.Stdin = strings.NewReader(cred.Value)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		_ = os.Remove(tmpFile)
+		return fmt.Errorf("systemd-creds encrypt failed: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+
+	if err := os.Chmod(tmpFile, 0600); err != nil {
+		_ = os.Remove(tmpFile)
+		return err
+	}
+
+	if err := os.Rename(tmpFile, filename); err != nil {
+		_ = os.Remove(tmpFile)
+		return err
+	}
+
+	key, err := credentialKey(true)
+	if err != nil {
+		return err
+	}
+
+	return linux.WriteFile(filename+credentialHashSuffix, []byte(credentialHash(key, cred.Value)), 0600)
+}
+
+// credentialKey returns the runner-local key of the credential hashes. A missing key is generated, if create is
+// true, and is nil otherwise.
+func credentialKey(create bool) ([]byte, error) {
+	key, err := os.ReadFile(credentialKeyFile)
+	if err == nil {
+		return key, nil
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cannot read credential key: %w", err)
+	}
+
+	if !create {
+		return nil, nil
+	}
+
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("cannot generate credential key: %w", err)
+	}
+
+	if err := linux.WriteFile(credentialKeyFile, key, 0600); err != nil {
+		return nil, fmt.Errorf("cannot write credential key: %w", err)
+	}
+
+	return key, nil
+}
+
+// credentialHash returns the hex encoded HMAC-SHA3-512 of the plaintext credential.
+func credentialHash(key []byte, value string) string {
+	mac := hmac.New(func() hash.Hash { return sha3.New512() }, key)
+	_, _ = mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// credentialUnit returns the declared unit of the application, which additionally loads all declared credentials.
+func credentialUnit(cfg configuration.Application) (configuration.ServiceUnit, error) {
+	unit := cfg.Sandbox.Unit
+	if len(cfg.Credentials) == 0 {
+		return unit, nil
+	}
+
+	store, err := newCredentialStore(cfg.InstID)
+	if err != nil {
+		return unit, err
+	}
+
+	if store.encrypted {
+		unit.Service.LoadCredentialEncrypted = append([]string(nil), unit.Service.LoadCredentialEncrypted...)
+	} else {
+		unit.Service.LoadCredential = append([]string(nil), unit.Service.LoadCredential...)
+	}
+
+	for _, cred := range cfg.Credentials {
+		if !cred.Name.Valid() {
+			return unit, fmt.Errorf("invalid credential name: %q", cred.Name)
+		}
+
+		if store.encrypted {
+			unit.Service.LoadCredentialEncrypted = append(unit.Service.LoadCredentialEncrypted, store.load(cred.Name))
+		} else {
+			unit.Service.LoadCredential = append(unit.Service.LoadCredential, store.load(cred.Name))
+		}
+	}
+
+	return unit, nil
+}
+
+// credentialsPending returns the names of all credentials, which would be written or removed.
+func credentialsPending(cfg configuration.Application) ([]string, error) {
+	var res []string
+	store, err := newCredentialStore(cfg.InstID)
+	if err != nil {
+		return nil, err
+	}
+
+	declared := map[string]bool{}
+	for _, cred := range cfg.Credentials {
+		declared[filepath.Base(store.filename(cred.Name))] = true
+		pending, err := store.pending(cred)
+		if err != nil {
+			return nil, fmt.Errorf("cannot check credential %s: %w", cred.Name, err)
+		}
+
+		if pending {
+			res = append(res, string(cred.Name))
+		}
+	}
+
+	files, err := undeclaredCredentials(store, declared)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		res = append(res, filepath.Base(file))
+	}
+
+	return res, nil
+}
+
+// updateCredentials writes all changed credentials of the application into its root-only credential directory
+// and removes any undeclared ones. It returns true, if the service needs a restart to see the changes.
+func updateCredentials(logger *slog.Logger, cfg configuration.Application) (bool, error) {
+	store, err := newCredentialStore(cfg.InstID)
+	if err != nil {
+		return false, err
+	}
+
+	if len(cfg.Credentials) == 0 {
+		if _, err := os.Stat(store.dir); os.IsNotExist(err) {
+			return false, nil
+		}
+
+		logger.Info("removing credentials", "dir", store.dir)
+		if err := os.RemoveAll(store.dir); err != nil {
+			return false, fmt.Errorf("cannot remove credentials: %w", err)
+		}
+
+		return true, nil
+	}
+
+	if err := os.MkdirAll(store.dir, 0700); err != nil {
+		return false, fmt.Errorf("cannot create credentials dir: %w", err)
+	}
+
+	// tighten the permissions, in case the directory has been created by someone else
+	if err := os.Chmod(store.dir, 0700); err != nil {
+		return false, fmt.Errorf("cannot chmod credentials dir: %w", err)
+	}
+
+	changed := false
+	declared := map[string]bool{}
+	for _, cred := range cfg.Credentials {
+		if !cred.Name.Valid() {
+			return false, fmt.Errorf("invalid credential name: %q", cred.Name)
+		}
+
+		declared[filepath.Base(store.filename(cred.Name))] = true
+		pending, err := store.pending(cred)
+		if err != nil {
+			return false, fmt.Errorf("cannot check credential %s: %w", cred.Name, err)
+		}
+
+		if !pending {
+			continue
+		}
+
+		logger.Info("writing credential", "instance", cfg.InstID, "name", cred.Name, "encrypted", store.encrypted)
+		if err := store.write(cred); err != nil {
+			return false, fmt.Errorf("cannot write credential %s: %w", cred.Name, err)
+		}
+
+		changed = true
+	}
+
+	files, err := undeclaredCredentials(store, declared)
+	if err != nil {
+		return false, err
+	}
+
+	for _, file := range files {
+		logger.Info("removing undeclared credential", "file", file)
+		if err := os.Remove(file); err != nil {
+			return false, fmt.Errorf("cannot remove credential: %w", err)
+		}
+
+		changed = true
+	}
+
+	return changed, nil
+}
+
+// undeclaredCredentials returns all files in the store, which neither are a declared credential nor its hash.
+func undeclaredCredentials(store credentialStore, declared map[string]bool) ([]string, error) {
+	entries, err := os.ReadDir(store.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("cannot read credentials dir: %w", err)
+	}
+
+	var res []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if declared[name] || (store.encrypted && declared[strings.TrimSuffix(name, credentialHashSuffix)]) {
+			continue
+		}
+
+		res = append(res, filepath.Join(store.dir, name))
+	}
+
+	return res, nil
+}
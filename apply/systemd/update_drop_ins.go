@@ -0,0 +1,119 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package systemd
+
+import (
+	"fmt"
+	"github.com/worldiety/nago-runner/configuration"
+	"github.com/worldiety/nago-runner/pkg/linux"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// dropInDir returns the directory of the declared drop-ins, which belongs to the main unit of the application.
+// The replica drop-ins are kept in the directories of the single replicas instead.
+func dropInDir(app configuration.Application) string {
+	return filepath.Join(systemdConfDir, unitName(app)+".service.d")
+}
+
+// renderDropIn generates the drop-in file with a header, which marks it as generated.
+func renderDropIn(dropIn configuration.DropIn) ([]byte, error) {
+	if !dropIn.Name.Valid() {
+		return nil, fmt.Errorf("invalid drop-in name: %q", dropIn.Name)
+	}
+
+	var w unitWriter
+	w.comment(`Code generated by "nago-runner"; DO NOT EDIT.`)
+	w.buf.WriteString(dropIn.Content)
+	if !strings.HasSuffix(dropIn.Content, "\n") {
+		w.buf.WriteString("\n")
+	}
+
+	return w.bytes()
+}
+
+// dropInFiles returns the expected content of all drop-ins of the application by their filename.
+func dropInFiles(app configuration.Application) (map[string][]byte, error) {
+	res := map[string][]byte{}
+	for _, dropIn := range app.DropIns {
+		buf, err := renderDropIn(dropIn)
+		if err != nil {
+			return nil, err
+		}
+
+		res[filepath.Join(dropInDir(app), string(dropIn.Name)+".conf")] = buf
+	}
+
+	return res, nil
+}
+
+// undeclaredDropIns returns the drop-ins of the main unit, which are not contained in the given expected files.
+func undeclaredDropIns(app configuration.Application, files map[string][]byte) ([]string, error) {
+	existing, err := filepath.Glob(filepath.Join(dropInDir(app), "*.conf"))
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(existing, func(filename string) bool {
+		_, ok := files[filename]
+		return ok
+	}), nil
+}
+
+// updateDropIns writes all changed drop-ins of the application and removes any other drop-in of its main unit. It
+// returns true, if a drop-in has been written or removed, because systemd applies them only on a restart.
+func updateDropIns(logger *slog.Logger, app configuration.Application) (bool, error) {
+	files, err := dropInFiles(app)
+	if err != nil {
+		return false, err
+	}
+
+	changed := false
+	for _, filename := range slices.Sorted(maps.Keys(files)) {
+		currentHash, err := linux.Sha3(filename)
+		if err != nil {
+			return false, fmt.Errorf("failed to calculate current hash: %w", err)
+		}
+
+		expectedHash, err := linux.Sha3Bytes(files[filename])
+		if err != nil {
+			return false, fmt.Errorf("failed to calculate expected hash: %w", err)
+		}
+
+		if currentHash == expectedHash {
+			continue
+		}
+
+		logger.Info("writing drop-in", "instance", app.InstID, "file", filename)
+		if err := linux.WriteFile(filename, files[filename], 0644); err != nil {
+			return false, fmt.Errorf("cannot write drop-in: %w", err)
+		}
+
+		changed = true
+	}
+
+	undeclared, err := undeclaredDropIns(app, files)
+	if err != nil {
+		return false, err
+	}
+
+	for _, filename := range undeclared {
+		logger.Info("removing undeclared drop-in", "instance", app.InstID, "file", filename)
+		if err := os.Remove(filename); err != nil {
+			return false, fmt.Errorf("cannot remove drop-in: %w", err)
+		}
+
+		changed = true
+	}
+
+	return changed, nil
+}
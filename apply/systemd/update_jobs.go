@@ -0,0 +1,136 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package systemd
+
+import (
+	"fmt"
+	"github.com/worldiety/nago-runner/configuration"
+	"github.com/worldiety/nago-runner/pkg/linux"
+	"log/slog"
+	"path/filepath"
+	"strings"
+)
+
+// jobUnitName returns the name of the service and timer unit of a job without the type suffix.
+func jobUnitName(app configuration.Application, job configuration.Job) string {
+	return app.InstID + "-job-" + string(job.Name)
+}
+
+// unitFiles returns the lower case base names of all unit files, which are generated for the application.
+func unitFiles(app configuration.Application) []string {
+	res := []string{strings.ToLower(unitName(app) + ".service")}
+	for _, job := range app.Jobs {
+		name := strings.ToLower(jobUnitName(app, job))
+		res = append(res, name+".service", name+".timer")
+	}
+
+	if usesSocket(app) {
+		res = append(res, strings.ToLower(app.InstID+".socket"))
+	}
+
+	return res
+}
+
+// renderJob generates the oneshot service and the timer unit of the given job. The service inherits the sandbox
+// and the credentials of the instance.
+func renderJob(app configuration.Application, job configuration.Job) (service []byte, timer []byte, err error) {
+	if !job.Name.Valid() {
+		return nil, nil, fmt.Errorf("invalid job name: %q", job.Name)
+	}
+
+	if job.Command.Cmd == "" || job.OnCalendar == "" {
+		return nil, nil, fmt.Errorf("job %s requires a command and a calendar event", job.Name)
+	}
+
+	unit, err := credentialUnit(app)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot declare credentials: %w", err)
+	}
+
+	description := fmt.Sprintf("%s job %s", app.InstID, job.Name)
+	unit.Unit.Description = description
+	unit.Install = configuration.InstallSection{}
+	unit.Service.Type = "oneshot"
+	unit.Service.ExecStart = job.Command
+	// hooks like a migration belong to the instance and must not run for each job
+	unit.Service.ExecStartPre = nil
+	unit.Service.ExecStartPost = nil
+	unit.Service.ExecStop = nil
+	unit.Service.ExecReload = nil
+	// a oneshot service is not restarted, the timer triggers the next run
+	unit.Service.Restart = ""
+	unit.Service.RestartSec = 0
+
+	service, err = renderServiceFile(app, job.Name, unit)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var w unitWriter
+	if err := writeMetaHeader(&w, app, job.Name); err != nil {
+		return nil, nil, err
+	}
+
+	renderTimerUnit(&w, description, job)
+	timer, err = w.bytes()
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot render timer %s: %w", job.Name, err)
+	}
+
+	return service, timer, nil
+}
+
+// jobFiles returns the expected content of all job unit files of the application by their filename.
+func jobFiles(app configuration.Application) (map[string][]byte, error) {
+	res := map[string][]byte{}
+	for _, job := range app.Jobs {
+		service, timer, err := renderJob(app, job)
+		if err != nil {
+			return nil, err
+		}
+
+		name := filepath.Join(systemdConfDir, jobUnitName(app, job))
+		res[name+".service"] = service
+		res[name+".timer"] = timer
+	}
+
+	return res, nil
+}
+
+// updateJobs writes all changed job unit files of the application. It returns the timers which have to be
+// (re)started after the systemd daemon has been reloaded. Undeclared jobs are removed as stale units.
+func updateJobs(logger *slog.Logger, app configuration.Application) ([]string, error) {
+	files, err := jobFiles(app)
+	if err != nil {
+		return nil, err
+	}
+
+	var timers []string
+	for _, job := range app.Jobs {
+		name := filepath.Join(systemdConfDir, jobUnitName(app, job))
+		changed := false
+		for _, filename := range []string{name + ".service", name + ".timer"} {
+			if linux.EqualBuf(filename, files[filename]) {
+				continue
+			}
+
+			logger.Info("writing job unit", "instance", app.InstID, "job", job.Name, "file", filename)
+			if err := linux.WriteFile(filename, files[filename], 0644); err != nil {
+				return nil, fmt.Errorf("cannot write job unit: %w", err)
+			}
+
+			changed = true
+		}
+
+		if changed {
+			timers = append(timers, jobUnitName(app, job)+".timer")
+		}
+	}
+
+	return timers, nil
+}
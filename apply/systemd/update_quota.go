@@ -0,0 +1,143 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package systemd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/worldiety/nago-runner/apply"
+	"github.com/worldiety/nago-runner/configuration"
+	"github.com/worldiety/nago-runner/pkg/linux"
+	"github.com/worldiety/nago-runner/service/event"
+	"log/slog"
+	"os"
+	"os/user"
+)
+
+// dataRoot contains the data directories of all instances and must be located on a filesystem with quota support.
+const dataRoot = "/var/lib/ngr"
+
+// updateQuotas enforces the declared disk quotas of all applications. A failure of a single application does
+// not affect the others.
+func updateQuotas(logger *slog.Logger, cfg configuration.Runner, report *apply.Report) error {
+	var errs []error
+	for _, app := range cfg.Applications {
+		if !app.Sandbox.Filesystem.Enabled {
+			continue
+		}
+
+		err := report.Step(app.InstID, "quota", func() error {
+			return updateQuota(logger, app)
+		})
+
+		if err != nil {
+			logger.Error("cannot apply disk quota", "instance", app.InstID, "err", err.Error())
+			errs = append(errs, fmt.Errorf("%s: %w", app.InstID, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func updateQuota(logger *slog.Logger, app configuration.Application) error {
+	limit, err := app.Sandbox.Filesystem.UsrQuota.Bytes()
+	if err != nil {
+		return err
+	}
+
+	if err := installQuota(logger); err != nil {
+		return err
+	}
+
+	mount, err := quotaMount()
+	if err != nil {
+		return err
+	}
+
+	uid, err := serviceUID(app)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("apply disk quota", "instance", app.InstID, "uid", uid, "limit", limit, "mount", mount.MountPoint)
+	return linux.SetUserQuota(uid, limit, mount.MountPoint)
+}
+
+// quotaMount returns the mount of the data root and fails, if the filesystem does not support user quotas.
+func quotaMount() (linux.Mount, error) {
+	if err := os.MkdirAll(dataRoot, 0755); err != nil {
+		return linux.Mount{}, fmt.Errorf("cannot create data root: %w", err)
+	}
+
+	mount, err := linux.FindMount(dataRoot)
+	if err != nil {
+		return linux.Mount{}, err
+	}
+
+	if !mount.UserQuota() || !mount.GroupQuota() {
+		return mount, fmt.Errorf("filesystem %s at %s is not mounted with usrquota,grpquota", mount.Device, mount.MountPoint)
+	}
+
+	return mount, nil
+}
+
+// serviceUID resolves the numeric id of the static user of the service. A dynamic user is rejected by
+// configuration.Runner.Validate, because its id is allocated on each start and the quota would be lost.
+func serviceUID(app configuration.Application) (string, error) {
+	name := app.Sandbox.Unit.Service.User
+	if name == "" {
+		return "", fmt.Errorf("cannot resolve service user: %s", app.InstID)
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", fmt.Errorf("cannot lookup service user: %s: %w", name, err)
+	}
+
+	return u.Uid, nil
+}
+
+func installQuota(logger *slog.Logger) error {
+	path, err := linux.Which("setquota")
+	if err != nil {
+		return fmt.Errorf("cannot find setquota executable: %w", err)
+	}
+
+	if path == "" {
+		logger.Warn("setquota executable not found in $PATH")
+		if err := linux.AptInstall("quota"); err != nil {
+			return fmt.Errorf("cannot install quota: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// QuotaUsage reports the current disk usage of a managed service against its declared quota.
+func QuotaUsage(service Service) (event.QuotaUsage, error) {
+	res := event.QuotaUsage{InstanceID: service.Application.InstID}
+	mount, err := quotaMount()
+	if err != nil {
+		return res, err
+	}
+
+	uid, err := serviceUID(service.Application)
+	if err != nil {
+		return res, err
+	}
+
+	usage, err := linux.UserQuotaUsage(uid, mount.MountPoint)
+	if err != nil {
+		return res, err
+	}
+
+	res.UID = uid
+	res.Used = usage.Used
+	res.Limit = usage.Limit
+	return res, nil
+}
@@ -0,0 +1,316 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package systemd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/worldiety/nago-runner/apply"
+	"github.com/worldiety/nago-runner/configuration"
+	"github.com/worldiety/nago-runner/pkg/linux"
+	"github.com/worldiety/nago-runner/pkg/run"
+	"github.com/worldiety/nago-runner/setup"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const restoreStateFile = "/var/lib/nago-runner/restore.json"
+
+// restoreState tracks which restore generation each instance has already applied successfully. It survives
+// runner restarts, so that each generation is only executed once.
+type restoreState struct {
+	// Applied maps the instance id to the last applied configuration.Restore.Generation.
+	Applied map[string]string `json:"applied,omitempty"`
+}
+
+func loadRestoreState() (restoreState, error) {
+	state := restoreState{Applied: map[string]string{}}
+	buf, err := os.ReadFile(restoreStateFile)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+
+	if err != nil {
+		return state, fmt.Errorf("cannot read restore state: %w", err)
+	}
+
+	// a broken state must not cause all restores to be executed again
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return state, fmt.Errorf("cannot parse restore state: %s: %w", restoreStateFile, err)
+	}
+
+	if state.Applied == nil {
+		state.Applied = map[string]string{}
+	}
+
+	return state, nil
+}
+
+func saveRestoreState(state restoreState) error {
+	buf, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot marshal restore state: %w", err)
+	}
+
+	if err := linux.WriteFile(restoreStateFile, buf, 0600); err != nil {
+		return fmt.Errorf("cannot write restore state: %w", err)
+	}
+
+	return nil
+}
+
+// restorePending returns true, if the declared restore is due and its generation has not been applied yet.
+func restorePending(cfg configuration.Application) (bool, error) {
+	restore := cfg.Restore
+	if !restore.Enabled || restore.ApplyAfter.After(time.Now()) {
+		return false, nil
+	}
+
+	state, err := loadRestoreState()
+	if err != nil {
+		return false, err
+	}
+
+	return state.Applied[cfg.InstID] != restore.Generation(), nil
+}
+
+// updateRestore executes the declared restore, if it is due and has not been applied yet. All changed files are
+// downloaded into a staging directory first, thus a failed download does not touch the data or the running units.
+// Afterwards, all units of the instance are stopped and the staged files are moved into the data directory. If
+// RemoveExtra is set, all other files are deleted. It returns true, if data has been restored and the service must
+// be (re)started. If the restore fails after the units have been stopped, they are started again.
+func updateRestore(logger *slog.Logger, settings setup.Settings, cfg configuration.Application) (bool, error) {
+	pending, err := restorePending(cfg)
+	if err != nil || !pending {
+		return false, err
+	}
+
+	set, err := apply.QueryFileSet(settings, cfg.Restore.FileSet)
+	if err != nil {
+		return false, fmt.Errorf("cannot query restore file set: %s: %w", cfg.Restore.FileSet, err)
+	}
+
+	// validate everything before touching any data
+	for _, file := range set.Files {
+		if err := file.Path.Validate(); err != nil {
+			return false, fmt.Errorf("invalid restore file path: %s: %w", file.Path, err)
+		}
+	}
+
+	dataDir := NewService(cfg.InstID).Paths().DataDirectory
+	stagingDir := dataDir + ".restore"
+	defer os.RemoveAll(stagingDir)
+
+	logger.Warn("restoring instance data", "instance", cfg.InstID, "fileSet", cfg.Restore.FileSet, "generation", cfg.Restore.Generation())
+	staged, declared, err := stageRestore(settings, set, dataDir, stagingDir)
+	if err != nil {
+		return false, err
+	}
+
+	stopped := stopInstanceUnits(logger, cfg)
+	if err := swapRestore(logger, cfg, staged, declared, dataDir, stagingDir); err != nil {
+		startUnits(logger, stopped)
+		return false, err
+	}
+
+	state, err := loadRestoreState()
+	if err != nil {
+		startUnits(logger, stopped)
+		return false, err
+	}
+
+	state.Applied[cfg.InstID] = cfg.Restore.Generation()
+	if err := saveRestoreState(state); err != nil {
+		startUnits(logger, stopped)
+		return false, err
+	}
+
+	logger.Info("restore completed", "instance", cfg.InstID, "files", len(set.Files))
+
+	return true, nil
+}
+
+// stageRestore downloads all files, whose hash differs from the current data file, into the staging directory. It
+// returns the relative paths of the staged files and of all declared files.
+func stageRestore(settings setup.Settings, set configuration.FileSet, dataDir, stagingDir string) (staged []string, declared map[string]bool, err error) {
+	if err := os.RemoveAll(stagingDir); err != nil {
+		return nil, nil, fmt.Errorf("cannot remove stale staging dir: %w", err)
+	}
+
+	declared = map[string]bool{}
+	for _, file := range set.Files {
+		rel := filepath.FromSlash(strings.TrimPrefix(string(file.Path), "/"))
+		declared[rel] = true
+
+		dst := filepath.Join(dataDir, rel)
+		hash, err := linux.Sha3(dst)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot hash data file: %s: %w", dst, err)
+		}
+
+		if hash == file.Hash {
+			continue
+		}
+
+		// security note: systemd requires 0700, see also https://github.com/systemd/systemd/issues/7659
+		tmpFile := filepath.Join(stagingDir, rel)
+		if err := os.MkdirAll(filepath.Dir(tmpFile), 0700); err != nil {
+			return nil, nil, fmt.Errorf("cannot create staging dir: %s: %w", tmpFile, err)
+		}
+
+		if err := download(settings, file.URL, tmpFile, file.Size, file.Hash); err != nil {
+			return nil, nil, fmt.Errorf("cannot download restore file: %s: %w", file.Path, err)
+		}
+
+		staged = append(staged, rel)
+	}
+
+	return staged, declared, nil
+}
+
+// swapRestore moves the staged files into the data directory, which is on the same filesystem, thus each file is
+// replaced atomically.
+func swapRestore(logger *slog.Logger, cfg configuration.Application, staged []string, declared map[string]bool, dataDir, stagingDir string) error {
+	for _, rel := range staged {
+		dst := filepath.Join(dataDir, rel)
+		if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			return fmt.Errorf("cannot create parent dir: %s: %w", dst, err)
+		}
+
+		if err := os.Rename(filepath.Join(stagingDir, rel), dst); err != nil {
+			return fmt.Errorf("cannot rename restore file: %s: %w", dst, err)
+		}
+	}
+
+	if cfg.Restore.RemoveExtra {
+		if err := removeUndeclared(logger, dataDir, declared); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// instanceUnits returns all units, which may access the data of the instance. The slots and replicas are returned
+// by their actual names, because stopping a template does not stop its instances. A socket is returned before
+// its service, so that it cannot start the service again.
+func instanceUnits(cfg configuration.Application) ([]string, error) {
+	switch {
+	case usesBlueGreen(cfg):
+		return []string{slotUnit(cfg.InstID, slotBlue) + ".service", slotUnit(cfg.InstID, slotGreen) + ".service"}, nil
+	case usesReplicas(cfg):
+		replicas, err := existingReplicas(cfg.InstID)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := 1; i <= cfg.Replicas.Count; i++ {
+			if !slices.Contains(replicas, i) {
+				replicas = append(replicas, i)
+			}
+		}
+
+		var res []string
+		for _, replica := range replicas {
+			res = append(res, replicaUnit(cfg.InstID, replica)+".service")
+		}
+
+		return res, nil
+	case usesSocket(cfg):
+		return []string{cfg.InstID + ".socket", cfg.InstID + ".service"}, nil
+	default:
+		return []string{cfg.InstID + ".service"}, nil
+	}
+}
+
+// stopInstanceUnits stops all units of the instance and returns those, which have been active.
+func stopInstanceUnits(logger *slog.Logger, cfg configuration.Application) []string {
+	units, err := instanceUnits(cfg)
+	if err != nil {
+		logger.Warn("cannot list units of instance, stopping main unit only", "instance", cfg.InstID, "err", err.Error())
+		units = []string{cfg.InstID + ".service"}
+	}
+
+	var active []string
+	for _, unit := range units {
+		props, err := linux.ServiceProperties(unit, "ActiveState")
+		if err == nil && props["ActiveState"] != "inactive" && props["ActiveState"] != "failed" {
+			active = append(active, unit)
+		}
+
+		logger.Info("stopping unit for restore", "unit", unit)
+		if err := run.Command("systemctl", "stop", unit); err != nil {
+			logger.Warn("failed to stop unit, ignoring", "unit", unit)
+		}
+	}
+
+	return active
+}
+
+// startUnits starts the given units again, e.g. after a failed restore.
+func startUnits(logger *slog.Logger, units []string) {
+	for _, unit := range units {
+		logger.Info("starting unit after failed restore", "unit", unit)
+		if err := run.Command("systemctl", "start", unit); err != nil {
+			logger.Warn("failed to start unit, ignoring", "unit", unit)
+		}
+	}
+}
+
+// removeUndeclared deletes all regular files within the data directory which are not declared.
+func removeUndeclared(logger *slog.Logger, dataDir string, declared map[string]bool) error {
+	var extra []string
+	err := fs.WalkDir(os.DirFS(dataDir), ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		if !declared[filepath.FromSlash(path)] {
+			extra = append(extra, path)
+		}
+
+		return nil
+	})
+
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot walk data dir: %s: %w", dataDir, err)
+	}
+
+	for _, path := range extra {
+		logger.Info("removing undeclared data file", "file", path)
+		if err := os.Remove(filepath.Join(dataDir, path)); err != nil {
+			return fmt.Errorf("cannot remove undeclared data file: %s: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// forgetRestore removes the tracked restore generation of a purged instance.
+func forgetRestore(instID string) error {
+	state, err := loadRestoreState()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := state.Applied[instID]; !ok {
+		return nil
+	}
+
+	delete(state.Applied, instID)
+	return saveRestoreState(state)
+}
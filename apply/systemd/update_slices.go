@@ -0,0 +1,172 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package systemd
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/worldiety/nago-runner/configuration"
+	"github.com/worldiety/nago-runner/pkg/linux"
+	"github.com/worldiety/nago-runner/pkg/run"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ngrSlicePrefix marks a slice unit as managed. In contrast to the other units, a slice does not belong to an
+// instance, thus it has no meta header and is never found by FindServices.
+const ngrSlicePrefix = "# ngr-slice: "
+
+// sliceUnit returns the unit name of the declared slice like ngr-acme.slice.
+func sliceUnit(name configuration.Name) string {
+	return "ngr-" + string(name) + ".slice"
+}
+
+// resolveSlices assigns each application to the unit of its declared slice, which has already been checked by
+// configuration.Runner.Validate. Like a dependency, the slice is added to the unit declaration of the application,
+// so that it is rendered into all of its units.
+func resolveSlices(apps []configuration.Application) []configuration.Application {
+	res := make([]configuration.Application, 0, len(apps))
+	for _, app := range apps {
+		if app.Slice != "" {
+			app.Sandbox.Unit.Service.Slice = sliceUnit(app.Slice)
+		}
+
+		res = append(res, app)
+	}
+
+	return res
+}
+
+// renderSlice generates the slice unit with its marker.
+func renderSlice(slice configuration.Slice) ([]byte, error) {
+	if !slice.Name.Valid() || strings.Contains(string(slice.Name), "-") {
+		return nil, fmt.Errorf("invalid slice name: %q", slice.Name)
+	}
+
+	var w unitWriter
+	w.buf.WriteString(ngrSlicePrefix + string(slice.Name) + "\n")
+	renderSliceUnit(&w, string(slice.Name)+" slice", slice)
+	buf, err := w.bytes()
+	if err != nil {
+		return nil, fmt.Errorf("cannot render slice %s: %w", slice.Name, err)
+	}
+
+	return buf, nil
+}
+
+// sliceFiles returns the expected content of all declared slice units by their filename.
+func sliceFiles(cfg configuration.Runner) (map[string][]byte, error) {
+	res := map[string][]byte{}
+	for _, slice := range cfg.Slices {
+		buf, err := renderSlice(slice)
+		if err != nil {
+			return nil, err
+		}
+
+		res[filepath.Join(systemdConfDir, sliceUnit(slice.Name))] = buf
+	}
+
+	return res, nil
+}
+
+// undeclaredSlices returns the filenames of all managed slice units, which are not contained in the given
+// expected files.
+func undeclaredSlices(files map[string][]byte) ([]string, error) {
+	candidates, err := filepath.Glob(filepath.Join(systemdConfDir, "ngr-*.slice"))
+	if err != nil {
+		return nil, err
+	}
+
+	var res []string
+	for _, filename := range candidates {
+		if _, ok := files[filename]; ok {
+			continue
+		}
+
+		buf, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read slice unit: %w", err)
+		}
+
+		// a slice created by hand is not ours to remove
+		if bytes.HasPrefix(buf, []byte(ngrSlicePrefix)) {
+			res = append(res, filename)
+		}
+	}
+
+	return res, nil
+}
+
+// updateSlices writes all changed slice units and returns true, if any has been written. The limits of a running
+// slice are applied by the next daemon reload, thus its units do not need to be restarted.
+func updateSlices(logger *slog.Logger, cfg configuration.Runner) (bool, error) {
+	files, err := sliceFiles(cfg)
+	if err != nil {
+		return false, err
+	}
+
+	changed := false
+	for _, filename := range slices.Sorted(maps.Keys(files)) {
+		currentHash, err := linux.Sha3(filename)
+		if err != nil {
+			return false, fmt.Errorf("failed to calculate current hash: %w", err)
+		}
+
+		expectedHash, err := linux.Sha3Bytes(files[filename])
+		if err != nil {
+			return false, fmt.Errorf("failed to calculate expected hash: %w", err)
+		}
+
+		if currentHash == expectedHash {
+			continue
+		}
+
+		logger.Info("writing slice unit", "file", filename)
+		if err := linux.WriteFile(filename, files[filename], 0644); err != nil {
+			return false, fmt.Errorf("cannot write slice unit: %w", err)
+		}
+
+		changed = true
+	}
+
+	return changed, nil
+}
+
+// removeSlices removes the units of all managed slices, which are not declared anymore. This must happen after the
+// services have been moved out of them, because stopping a slice would stop all of its units. An empty slice is
+// collected by systemd after the daemon reload.
+func removeSlices(logger *slog.Logger, cfg configuration.Runner) error {
+	files, err := sliceFiles(cfg)
+	if err != nil {
+		return err
+	}
+
+	undeclared, err := undeclaredSlices(files)
+	if err != nil {
+		return err
+	}
+
+	for _, filename := range undeclared {
+		logger.Info("removing undeclared slice unit", "file", filename)
+		if err := os.Remove(filename); err != nil {
+			return fmt.Errorf("cannot remove slice unit: %w", err)
+		}
+	}
+
+	if len(undeclared) > 0 {
+		if err := run.Command("systemctl", "daemon-reload"); err != nil {
+			return fmt.Errorf("error reloading systemd daemon: %w", err)
+		}
+	}
+
+	return nil
+}
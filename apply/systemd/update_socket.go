@@ -0,0 +1,101 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package systemd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/worldiety/nago-runner/configuration"
+	"github.com/worldiety/nago-runner/pkg/linux"
+	"github.com/worldiety/nago-runner/pkg/run"
+	"log/slog"
+	"path/filepath"
+)
+
+func usesSocket(app configuration.Application) bool {
+	return app.Socket.Declared()
+}
+
+func socketFilename(app configuration.Application) string {
+	return filepath.Join(systemdConfDir, app.InstID+".socket")
+}
+
+// renderSocket generates the socket unit of the application.
+func renderSocket(app configuration.Application) ([]byte, error) {
+	if usesBlueGreen(app) || usesReplicas(app) {
+		return nil, errors.New("socket activation cannot be combined with blue/green deployments or replicas")
+	}
+
+	var w unitWriter
+	if err := writeMetaHeader(&w, app, ""); err != nil {
+		return nil, err
+	}
+
+	renderSocketUnit(&w, app.InstID+" socket", app.Socket)
+	buf, err := w.bytes()
+	if err != nil {
+		return nil, fmt.Errorf("cannot render socket %s: %w", app.InstID, err)
+	}
+
+	return buf, nil
+}
+
+// updateSocket writes the socket unit of the application and returns true, if it has changed. A socket which is
+// not declared anymore is removed as a stale unit.
+func updateSocket(logger *slog.Logger, app configuration.Application) (bool, error) {
+	if !usesSocket(app) {
+		return false, nil
+	}
+
+	buf, err := renderSocket(app)
+	if err != nil {
+		return false, err
+	}
+
+	filename := socketFilename(app)
+	if linux.EqualBuf(filename, buf) {
+		return false, nil
+	}
+
+	logger.Info("writing socket unit", "instance", app.InstID, "file", filename)
+	if err := linux.WriteFile(filename, buf, 0644); err != nil {
+		return false, fmt.Errorf("cannot write socket unit: %w", err)
+	}
+
+	return true, nil
+}
+
+// restartSocketActivated puts a changed socket activated service into operation. The service itself is not
+// started, that happens on the first request. A changed socket requires the service to be stopped, because the
+// socket cannot be restarted while its service is still running.
+func restartSocketActivated(logger *slog.Logger, d deployment) {
+	socket := d.app.InstID + ".socket"
+	logger.Info("enable socket", "socket", socket)
+	if err := run.Command("systemctl", "enable", socket); err != nil {
+		slog.Warn("failed to enable socket, ignoring", "socket", socket)
+	}
+
+	// a resurrected socket has been stopped as a tombstone
+	if !d.changes.Socket && !d.changes.Resurrected {
+		logger.Info("restart service if running", "service", d.service.Name())
+		if err := run.Command("systemctl", "try-restart", d.service.Name()); err != nil {
+			slog.Warn("failed to restart service, ignoring", "service", d.service.Name())
+		}
+
+		return
+	}
+
+	logger.Info("restart socket", "socket", socket)
+	if err := run.Command("systemctl", "stop", d.service.Name()); err != nil {
+		slog.Warn("failed to stop service, ignoring", "service", d.service.Name())
+	}
+
+	if err := run.Command("systemctl", "restart", socket); err != nil {
+		slog.Warn("failed to restart socket, ignoring", "socket", socket)
+	}
+}
@@ -8,284 +8,166 @@
 package systemd
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/worldiety/nago-runner/configuration"
 	"github.com/worldiety/nago-runner/pkg/linux"
 	"github.com/worldiety/nago-runner/setup"
 	"log/slog"
-	"strings"
+	"os"
+	"reflect"
 )
 
 // updateSystemd regenerates the entire systemd service unit file and rewrites and reloads systemd if required.
 // If nothing has changed, this does nothing.
 func updateSystemd(logger *slog.Logger, settings setup.Settings, cfg configuration.Application) (bool, error) {
-	var f bytes.Buffer
-	// header
-	buf, err := json.Marshal(cfg)
+	buf, err := renderUnit(cfg)
 	if err != nil {
-		return false, fmt.Errorf("failed to marshal configuration: %w", err)
+		return false, err
 	}
 
-	f.WriteString(ngrMetaPrefix)
-	f.Write(buf)
-	f.WriteString("\n\n")
-
-	unit := cfg.Sandbox.Unit.Unit
-	f.WriteString("[Unit]\n")
-	f.WriteString("Description=" + unit.Description + "\n")
-	if unit.After != "" {
-		f.WriteString("After=" + string(unit.After) + "\n")
-	}
-
-	f.WriteString("\n")
-
-	// ###
-	service := cfg.Sandbox.Unit.Service
-	f.WriteString("[Service]\n")
-	if service.Type != "" {
-		f.WriteString(fmt.Sprintf("Type=%s\n", service.Type))
-	}
-
-	if service.User != "" {
-		f.WriteString(fmt.Sprintf("User=%s\n", service.User))
-	}
-
-	if service.Group != "" {
-		f.WriteString(fmt.Sprintf("Group=%s\n", service.Group))
-	}
-
-	if service.BindPaths != "" {
-		f.WriteString(fmt.Sprintf("BindPaths=%s\n", service.BindPaths))
-	}
-
-	if service.BindReadOnlyPaths != "" {
-		f.WriteString(fmt.Sprintf("BindReadOnlyPaths=%s\n", service.BindReadOnlyPaths))
-	}
-
-	if service.ReadOnlyPaths != "" {
-		f.WriteString(fmt.Sprintf("ReadOnlyPaths=%s\n", service.ReadOnlyPaths))
-	}
-
-	if service.InaccessiblePaths != "" {
-		f.WriteString(fmt.Sprintf("InaccessiblePaths=%s\n", service.InaccessiblePaths))
-	}
-
-	if service.ExecPaths != "" {
-		f.WriteString(fmt.Sprintf("ExecPaths=%s\n", service.ExecPaths))
-	}
-
-	if service.AppArmorProfile != "" {
-		f.WriteString(fmt.Sprintf("AppArmorProfile=%s\n", service.AppArmorProfile))
-	}
-
-	if service.StateDirectory != "" {
-		f.WriteString(fmt.Sprintf("StateDirectory=%s\n", service.StateDirectory))
-	}
-
-	if service.SystemCallFilter != "" {
-		f.WriteString(fmt.Sprintf("SystemCallFilter=%s\n", service.SystemCallFilter))
-	}
-
-	if service.PrivateTmp {
-		f.WriteString("PrivateTmp=yes\n")
-	}
-
-	if service.MemoryDenyWriteExecute {
-		f.WriteString("MemoryDenyWriteExecute=yes\n")
-	}
-
-	if service.DynamicUser {
-		f.WriteString("DynamicUser=yes\n")
-	}
-
-	if service.NoNewPrivileges {
-		f.WriteString("NoNewPrivileges=yes\n")
-	}
-
-	if service.PrivateDevices {
-		f.WriteString("PrivateDevices=yes\n")
-	}
-
-	if service.PrivateIPC {
-		f.WriteString("PrivateIPC=yes\n")
-	}
-
-	if service.PrivatePIDs {
-		f.WriteString("PrivatePIDs=yes\n")
-	}
-
-	if service.PrivateMounts {
-		f.WriteString("PrivateMounts=yes\n")
-	}
-
-	if service.PrivateNetwork {
-		f.WriteString("PrivateNetwork=yes\n")
-	}
-
-	if service.PrivateUsers != "" {
-		f.WriteString(fmt.Sprintf("PrivateUsers=%s\n", service.PrivateUsers))
-	}
-
-	if service.ProtectKernelModules {
-		f.WriteString("ProtectKernelModules=yes\n")
-	}
-
-	if service.ProtectKernelTunables {
-		f.WriteString("ProtectKernelTunables=yes\n")
-	}
-
-	if service.ProtectClock {
-		f.WriteString("ProtectClock=yes\n")
-	}
-
-	if service.ProtectKernelLogs {
-		f.WriteString("ProtectKernelLogs=yes\n")
-	}
-
-	if service.ProtectHostname {
-		f.WriteString("ProtectHostname=yes\n")
-	}
-
-	if service.SetLoginEnvironment {
-		f.WriteString("SetLoginEnvironment=yes\n")
-	}
-
-	if service.RestrictSUIDSGID {
-		f.WriteString("RestrictSUIDSGID=yes\n")
-	}
-
-	if service.RestrictRealtime {
-		f.WriteString("RestrictRealtime=yes\n")
-	}
-
-	if service.MemoryDenyWriteExecute {
-		f.WriteString("MemoryDenyWriteExecute=yes\n")
-	}
-
-	for _, ns := range service.RestrictNamespaces {
-		f.WriteString(fmt.Sprintf("RestrictNamespaces=%s\n", ns))
-	}
-
-	if service.ProtectHome != "" {
-		f.WriteString(fmt.Sprintf("ProtectHome=%s\n", service.ProtectHome))
-	}
-
-	if service.ProtectSystem != "" {
-		f.WriteString(fmt.Sprintf("ProtectSystem=%s\n", service.ProtectSystem))
-	}
-
-	if service.ProtectControlGroups != "" {
-		f.WriteString(fmt.Sprintf("ProtectControlGroups=%s\n", service.ProtectControlGroups))
-	}
-
-	if service.ProtectProc != "" {
-		f.WriteString(fmt.Sprintf("ProtectProc=%s\n", service.ProtectProc))
-	}
-
-	f.WriteString(fmt.Sprintf("ExecStart=%s %s\n", service.ExecStart.Cmd, strings.Join(service.ExecStart.Args, " ")))
-	for _, env := range service.Environment {
-		f.WriteString(fmt.Sprintf("Environment=%s=%s\n", env.Key, env.Value))
-	}
-
-	for _, c := range service.CapabilityBoundingSet {
-		f.WriteString(fmt.Sprintf("CapabilityBoundingSet=%s\n", c))
+	fakeService := NewService(unitName(cfg))
+	currentHash, err := linux.Sha3(fakeService.UnitFilename)
+	if err != nil {
+		return false, fmt.Errorf("failed to calculate current hash: %w", err)
 	}
 
-	if service.Restart != "" {
-		f.WriteString(fmt.Sprintf("Restart=%s\n", service.Restart))
+	expectedHash, err := linux.Sha3Bytes(buf)
+	if err != nil {
+		return false, fmt.Errorf("failed to calculate expected hash: %w", err)
 	}
 
-	if service.RestartSec != 0 {
-		f.WriteString(fmt.Sprintf("RestartSec=%s\n", service.RestartSec.String()))
+	if currentHash == expectedHash {
+		slog.Info("systemd service unit file unchanged", "expected", expectedHash, "file", fakeService.UnitFilename)
+		return false, nil
 	}
 
-	if service.MemoryHigh != "" {
-		f.WriteString(fmt.Sprintf("MemoryHigh=%s\n", service.MemoryHigh))
+	slog.Info("systemd service unit file expected hash does not match the current hash", "expected", expectedHash, "actual", currentHash)
+	if err := keepPrevious(fakeService.UnitFilename); err != nil {
+		return false, err
 	}
 
-	if service.MemorySwapMax != "" {
-		f.WriteString(fmt.Sprintf("MemorySwapMax=%s\n", service.MemorySwapMax))
+	// units of former runner versions have been world-readable and contained secrets in their header
+	if err := os.Chmod(fakeService.UnitFilename+prevSuffix, 0600); err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("cannot protect previous unit file: %w", err)
 	}
 
-	if service.StartupMemoryHigh != "" {
-		f.WriteString(fmt.Sprintf("StartupMemoryHigh=%s\n", service.StartupMemoryHigh))
+	if err := linux.WriteFile(fakeService.UnitFilename, buf, 0644); err != nil {
+		return false, fmt.Errorf("failed to update systemd service unit file: %w", err)
 	}
 
-	if service.StartupMemorySwapMax != "" {
-		f.WriteString(fmt.Sprintf("StartupMemorySwapMax=%s\n", service.StartupMemorySwapMax))
-	}
+	return true, nil
+}
 
-	if service.OOMPolicy != "" {
-		f.WriteString(fmt.Sprintf("OOMPolicy=%s\n", service.OOMPolicy))
+// renderUnit generates the entire systemd service unit file content for the given application. The result is
+// parsed again and must yield the declared unit, otherwise a value has not survived quoting and escaping.
+func renderUnit(cfg configuration.Application) ([]byte, error) {
+	unit, err := credentialUnit(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("cannot declare credentials: %w", err)
 	}
 
-	if service.OOMScoreAdjust != 0 {
-		f.WriteString(fmt.Sprintf("OOMScoreAdjust=%d\n", service.OOMScoreAdjust))
-	}
+	unit = slotUnitConfiguration(cfg, unit)
 
-	if service.CPUWeight != 0 {
-		f.WriteString(fmt.Sprintf("CPUWeight=%d\n", service.CPUWeight))
-	}
+	return renderServiceFile(cfg, "", unit)
+}
 
-	if service.CPUQuota != 0 {
-		f.WriteString(fmt.Sprintf("CPUQuota=%d\n", service.CPUQuota))
+// renderServiceFile renders the given service unit with the meta header, which marks it as managed and owned by
+// the application. The header of a job unit also names the job.
+func renderServiceFile(cfg configuration.Application, job configuration.Name, unit configuration.ServiceUnit) ([]byte, error) {
+	var w unitWriter
+	if err := writeMetaHeader(&w, cfg, job); err != nil {
+		return nil, err
 	}
 
-	for _, sec := range service.SecureBits {
-		f.WriteString(fmt.Sprintf("SecureBits=%s\n", sec))
+	renderServiceUnit(&w, unit)
+	unitFile, err := w.bytes()
+	if err != nil {
+		return nil, fmt.Errorf("cannot render unit %s: %w", cfg.InstID, err)
 	}
 
-	for _, sec := range service.SocketBindAllow {
-		f.WriteString(fmt.Sprintf("SocketBindAllow=%s\n", sec))
+	parsed, err := ParseUnit(unitFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse rendered unit %s: %w", cfg.InstID, err)
 	}
 
-	for _, sec := range service.SocketBindDeny {
-		f.WriteString(fmt.Sprintf("SocketBindDeny=%s\n", sec))
+	if !reflect.DeepEqual(normalizeUnit(parsed), normalizeUnit(unit)) {
+		return nil, fmt.Errorf("rendered unit %s does not round-trip, check the declaration for unsupported values", cfg.InstID)
 	}
 
-	if service.KillMode != "" {
-		f.WriteString(fmt.Sprintf("KillMode=%s\n", service.KillMode))
-	}
+	return unitFile, nil
+}
 
-	if service.KillSignal != "" {
-		f.WriteString(fmt.Sprintf("KillSignal=%s\n", service.KillSignal))
+// writeMetaHeader writes the redacted application, because unit files are world-readable and therefore must not
+// contain any secrets.
+func writeMetaHeader(w *unitWriter, cfg configuration.Application, job configuration.Name) error {
+	buf, err := json.Marshal(cfg.Redacted())
+	if err != nil {
+		return fmt.Errorf("failed to marshal configuration: %w", err)
 	}
 
-	if service.TimeoutStopSec != 0 {
-		f.WriteString(fmt.Sprintf("TimeoutStopSec=%s\n", service.TimeoutStopSec.String()))
+	w.buf.WriteString(ngrMetaPrefix)
+	w.buf.Write(buf)
+	w.buf.WriteString("\n")
+	if job != "" {
+		w.buf.WriteString(ngrJobPrefix + string(job) + "\n")
 	}
 
-	// ###
-	install := cfg.Sandbox.Unit.Install
-	f.WriteString("[Install]\n")
-	if install.WantedBy != "" {
-		f.WriteString(fmt.Sprintf("WantedBy=%s\n", install.WantedBy))
-	}
+	return nil
+}
 
-	// finally, check if changed
+// normalizeUnit replaces empty slices with nil, which are equivalent for a unit file. After is just the first
+// entry of AfterUnits.
+func normalizeUnit(unit configuration.ServiceUnit) configuration.ServiceUnit {
+	u := &unit.Unit
+	if u.After != "" {
+		u.AfterUnits = append([]configuration.Name{u.After}, u.AfterUnits...)
+		u.After = ""
+	}
+
+	u.AfterUnits = nilIfEmpty(u.AfterUnits)
+	u.Requires = nilIfEmpty(u.Requires)
+	u.Wants = nilIfEmpty(u.Wants)
+	u.BindsTo = nilIfEmpty(u.BindsTo)
+
+	s := &unit.Service
+	s.SocketBindAllow = nilIfEmpty(s.SocketBindAllow)
+	s.SocketBindDeny = nilIfEmpty(s.SocketBindDeny)
+	s.RestrictNamespaces = nilIfEmpty(s.RestrictNamespaces)
+	s.Environment = nilIfEmpty(s.Environment)
+	s.EnvironmentFile = nilIfEmpty(s.EnvironmentFile)
+	s.LoadCredential = nilIfEmpty(s.LoadCredential)
+	s.LoadCredentialEncrypted = nilIfEmpty(s.LoadCredentialEncrypted)
+	s.CapabilityBoundingSet = nilIfEmpty(s.CapabilityBoundingSet)
+	s.SecureBits = nilIfEmpty(s.SecureBits)
+	s.IOReadBandwidthMax = nilIfEmpty(s.IOReadBandwidthMax)
+	s.IOWriteBandwidthMax = nilIfEmpty(s.IOWriteBandwidthMax)
+	s.ExecStart.Args = nilIfEmpty(s.ExecStart.Args)
+	s.ExecStartPre = normalizeCommands(s.ExecStartPre)
+	s.ExecStartPost = normalizeCommands(s.ExecStartPost)
+	s.ExecStop = normalizeCommands(s.ExecStop)
+	s.ExecReload = normalizeCommands(s.ExecReload)
+	return unit
+}
 
-	fakeService := NewService(cfg.InstID)
-	currentHash, err := linux.Sha3(fakeService.UnitFilename)
-	if err != nil {
-		return false, fmt.Errorf("failed to calculate current hash: %w", err)
+func normalizeCommands(cmds []configuration.Command) []configuration.Command {
+	if len(cmds) == 0 {
+		return nil
 	}
 
-	expectedHash, err := linux.Sha3Bytes(f.Bytes())
-	if err != nil {
-		return false, fmt.Errorf("failed to calculate expected hash: %w", err)
+	res := make([]configuration.Command, 0, len(cmds))
+	for _, cmd := range cmds {
+		cmd.Args = nilIfEmpty(cmd.Args)
+		res = append(res, cmd)
 	}
 
-	if currentHash == expectedHash {
-		slog.Info("systemd service unit file unchanged", "expected", expectedHash, "file", fakeService.UnitFilename)
-		return false, nil
-	}
+	return res
+}
 
-	slog.Info("systemd service unit file expected hash does not match the current hash", "expected", expectedHash, "actual", currentHash)
-	if err := linux.WriteFile(fakeService.UnitFilename, f.Bytes(), 0666); err != nil {
-		return false, fmt.Errorf("failed to update systemd service unit file: %w", err)
+func nilIfEmpty[T any](s []T) []T {
+	if len(s) == 0 {
+		return nil
 	}
 
-	return true, nil
+	return s
 }
@@ -0,0 +1,55 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package apply
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/worldiety/nago-runner/pkg/linux"
+	"os"
+)
+
+const upstreamsFile = "/var/lib/nago-runner/upstreams.json"
+
+// Upstreams maps an instance to the local ports, which currently serve its traffic. It is maintained by the
+// systemd apply for instances which are not simply restarted in place, like blue/green deployments. The caddy
+// apply proxies the rules of these instances to the listed ports instead of the declared rule port.
+type Upstreams map[string][]int
+
+// LoadUpstreams returns the persisted upstreams or an empty map, if nothing has been persisted yet.
+func LoadUpstreams() (Upstreams, error) {
+	res := Upstreams{}
+	buf, err := os.ReadFile(upstreamsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return res, nil
+		}
+
+		return nil, fmt.Errorf("cannot read upstreams: %w", err)
+	}
+
+	if err := json.Unmarshal(buf, &res); err != nil {
+		return nil, fmt.Errorf("cannot parse upstreams: %s: %w", upstreamsFile, err)
+	}
+
+	return res, nil
+}
+
+// Save persists the upstreams atomically.
+func (u Upstreams) Save() error {
+	buf, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	if err := linux.WriteFile(upstreamsFile, buf, 0644); err != nil {
+		return fmt.Errorf("cannot write upstreams: %w", err)
+	}
+
+	return nil
+}
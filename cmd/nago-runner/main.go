@@ -9,10 +9,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/worldiety/nago-runner/apply"
 	"github.com/worldiety/nago-runner/apply/caddy"
+	"github.com/worldiety/nago-runner/apply/drift"
+	"github.com/worldiety/nago-runner/apply/health"
+	"github.com/worldiety/nago-runner/apply/purge"
 	"github.com/worldiety/nago-runner/apply/systemd"
+	"github.com/worldiety/nago-runner/configuration"
 	"github.com/worldiety/nago-runner/service"
 	"github.com/worldiety/nago-runner/service/event"
 	"github.com/worldiety/nago-runner/service/event/gorilla"
@@ -21,6 +26,7 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 )
 
@@ -74,24 +80,151 @@ func realMain() error {
 func launch(ctx context.Context, bus *gorilla.WebsocketBus, settings setup.Settings) {
 	ucService := service.NewUseCases(bus, settings)
 	ucService.ScheduleStatistics(ctx)
+	healthMonitor := health.NewMonitor(bus)
+
+	// configuration changes and drift repairs must never be applied concurrently
+	var applyMutex sync.Mutex
+	applyConfiguration := func(cfg configuration.Runner) error {
+		report := apply.NewReport(cfg)
+
+		// a mass removal is refused before the reverse proxy drops the routes of the instances
+		if err := systemd.CheckRemoval(slog.Default(), cfg); err != nil {
+			slog.Error("refusing configuration", "err", err.Error())
+			bus.Publish(report.Complete(err))
+			return err
+		}
+
+		var errs []error
+		if err := caddy.Apply(slog.Default(), settings, cfg, report); err != nil {
+			slog.Error("cannot apply caddy configuration", "err", err.Error())
+			errs = append(errs, err)
+		}
+
+		switchProxy := func() error {
+			return caddy.Apply(slog.Default(), settings, cfg, nil)
+		}
+
+		if err := systemd.Apply(slog.Default(), settings, bus, cfg, switchProxy, report); err != nil {
+			slog.Error("cannot apply systemd configuration", "err", err.Error())
+			errs = append(errs, err)
+		}
+
+		healthMonitor.Update(ctx, cfg)
+
+		err := errors.Join(errs...)
+		bus.Publish(report.Complete(err))
+
+		return err
+	}
+
+	reconciler := drift.NewReconciler(bus, &applyMutex, applyConfiguration)
+
+	// undeclared instances are only deleted after their final backup
+	purger := purge.NewPurger(bus, &applyMutex, func(instID string) error {
+		return ucService.DoBackup(event.BackupRequest{InstanceID: instID})
+	})
+
+	go purger.Run(ctx)
+
+	// the last valid configuration is persisted, so that the runner can reconcile without the hub
+	var hubApplied bool
+	applyAndPersist := func(cfg configuration.Runner, fromHub bool) {
+		applyMutex.Lock()
+		defer applyMutex.Unlock()
+
+		if !fromHub && hubApplied {
+			// the persisted configuration is outdated and would purge instances, which have been added since
+			return
+		}
+
+		// an invalid configuration is rejected as a whole, before anything has been touched
+		if err := cfg.Validate(); err != nil {
+			slog.Error("rejecting invalid configuration", "err", err.Error())
+			bus.Publish(apply.NewReport(cfg).Complete(err))
+			return
+		}
+
+		hubApplied = hubApplied || fromHub
+
+		// a failed instance does not revert the configuration: the failures are reported per instance and the
+		// attempted configuration is persisted and watched anyway, because reconciling with an older one would
+		// undo everything which has succeeded and turn the instances added since into tombstones
+		if err := applyConfiguration(cfg); err != nil {
+			slog.Warn("configuration applied with failures", "err", err.Error())
+		}
+
+		if v, err := apply.SaveAppliedConfiguration(cfg); err != nil {
+			slog.Error("cannot persist applied configuration", "err", err.Error())
+		} else {
+			slog.Info("configuration applied", "version", v.Version, "hash", v.Hash)
+		}
+
+		reconciler.Update(ctx, cfg)
+	}
+
+	go func() {
+		cfg, v, err := apply.LoadAppliedConfiguration()
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			slog.Info("no applied configuration found, waiting for the hub")
+		case err != nil:
+			// never apply a damaged state, it may lack instances and cause them to be purged
+			slog.Error("cannot load applied configuration, waiting for the hub", "err", err.Error())
+		default:
+			slog.Info("reconciling with last applied configuration", "version", v.Version, "appliedAt", v.AppliedAt, "hash", v.Hash)
+			applyAndPersist(cfg, false)
+		}
+	}()
 
 	bus.Subscribe(func(obj event.Event) {
-		if _, ok := obj.(event.RunnerConfigurationChanged); ok {
+		switch obj := obj.(type) {
+		case event.RunnerConfigurationChanged:
 			cfg, err := apply.QueryConfiguration(settings)
 			if err != nil {
 				slog.Error("cannot load configuration", "err", err.Error())
 				return
 			}
 
-			if err := caddy.Apply(slog.Default(), settings, cfg); err != nil {
-				slog.Error("cannot apply caddy configuration", "err", err.Error())
-			}
+			applyAndPersist(cfg, true)
 
-			if err := systemd.Apply(slog.Default(), settings, cfg); err != nil {
-				slog.Error("cannot apply systemd configuration", "err", err.Error())
+		case event.PurgeConfirmed:
+			purger.Confirm(obj.InstanceID)
+		case event.PlanRequested:
+			plan, err := planConfiguration(settings)
+			if err != nil {
+				slog.Error("cannot plan configuration", "err", err.Error())
+				bus.Publish(event.PlanResponse{RequestID: obj.RequestID, Error: err.Error()})
+				return
 			}
 
+			bus.Publish(event.PlanResponse{RequestID: obj.RequestID, Plan: plan})
 		}
 	})
 
 }
+
+// planConfiguration loads the current configuration and calculates all pending changes without applying them.
+func planConfiguration(settings setup.Settings) (event.Plan, error) {
+	cfg, err := apply.QueryConfiguration(settings)
+	if err != nil {
+		return event.Plan{}, fmt.Errorf("cannot load configuration: %w", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return event.Plan{}, err
+	}
+
+	plan, err := systemd.Plan(slog.Default(), cfg)
+	if err != nil {
+		return event.Plan{}, fmt.Errorf("cannot plan systemd configuration: %w", err)
+	}
+
+	caddyChanges, err := caddy.Plan(cfg)
+	if err != nil {
+		return event.Plan{}, fmt.Errorf("cannot plan caddy configuration: %w", err)
+	}
+
+	plan.Files = append(plan.Files, caddyChanges...)
+
+	return plan, nil
+}
@@ -9,8 +9,13 @@
 package configuration
 
 import (
+	"crypto/sha3"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -18,6 +23,78 @@ import (
 // Runner describes all applications which this runner needs to provision.
 type Runner struct {
 	Applications []Application `json:"applications"`
+	// Cache configures the artifact cache, which is shared by all instances of the runner.
+	Cache Cache `json:"cache,omitzero"`
+	// Reconciliation configures the periodic comparison of the machine with this configuration.
+	Reconciliation Reconciliation `json:"reconciliation,omitzero"`
+	// Security configures the sandboxing policy for all instances.
+	Security Security `json:"security,omitzero"`
+	// Purge configures how instances, which are not declared anymore, are removed.
+	Purge Purge `json:"purge,omitzero"`
+	// Slices limit the resources of multiple applications together, e.g. of all applications of an organisation.
+	Slices []Slice `json:"slices,omitempty"`
+}
+
+// Slice is a systemd slice unit ngr-<Name>.slice, see systemd.slice(5). The units of all applications which are
+// assigned to the slice run beneath it, thus its limits apply to all of them together. All declared slices are
+// beneath the implicit ngr.slice. Systemd treats a dash in a slice name as nesting, thus the Name must not contain
+// a dash. Slices which are not declared anymore are removed.
+type Slice struct {
+	// Name of the slice, e.g. the organisation.
+	Name Name `json:"name"`
+	// MemoryMax is the hard limit of the memory usage, processes are killed by the OOM killer above it. See also
+	// ServiceSection.MemoryHigh.
+	MemoryMax Memory `json:"memoryMax,omitempty"`
+	// CPUQuota is the maximum CPU time in percent of a single CPU, e.g. 200 for two CPUs.
+	CPUQuota int `json:"CPUQuota,omitempty"`
+	// IOWeight is the relative block IO weight between 1 and 10000. The kernel default is 100.
+	IOWeight int `json:"IOWeight,omitempty"`
+	// TasksMax is the maximum number of processes and threads.
+	TasksMax int `json:"tasksMax,omitempty"`
+}
+
+// Purge describes the removal of instances, which are not declared anymore. Their services are stopped at once and
+// the instance becomes a tombstone. Its data is only deleted after a final backup and a grace period, or as soon as
+// the hub confirms the purge. If the instance is declared again in the meantime, it is started with its data.
+type Purge struct {
+	// GracePeriod after which the data of a tombstone is deleted, if its final backup has succeeded. Defaults to
+	// 7 days.
+	GracePeriod time.Duration `json:"gracePeriod,omitempty"`
+	// MaxPercent of the instances on the runner, which may become tombstones by a single apply. A larger removal
+	// indicates an incomplete configuration and is refused as a whole. A single instance can always be removed.
+	// Defaults to 50.
+	MaxPercent int `json:"maxPercent,omitempty"`
+}
+
+// Security describes the minimum sandboxing of every instance. Before each apply, the rendered main unit of each
+// instance is audited by systemd-analyze security, whose overall exposure level ranges from 0.0 (fully sandboxed) to
+// 10.0 (not sandboxed at all). Thus, a lower exposure means a better score.
+type Security struct {
+	// MaxExposure is the highest accepted exposure level, e.g. 5.0. Zero disables the policy, but the exposure is
+	// still reported.
+	MaxExposure float64 `json:"maxExposure,omitempty"`
+	// Enforce refuses every unit, which exceeds MaxExposure or cannot be audited: it is not installed and the
+	// running units of its instance are stopped and disabled. Otherwise, the unit is only flagged.
+	Enforce bool `json:"enforce,omitempty"`
+}
+
+// Reconciliation describes how the runner detects drift between the last applied configuration and the actual
+// state of the machine, e.g. a hand edited unit file, a deleted executable, a changed Caddyfile or a stopped
+// service.
+type Reconciliation struct {
+	// Interval between two comparisons. Defaults to 5 minutes.
+	Interval time.Duration `json:"interval,omitempty"`
+	// Repair applies the last configuration again and starts stopped services, as soon as a drift has been
+	// detected. Otherwise, the drift is only reported.
+	Repair bool `json:"repair,omitempty"`
+}
+
+// Cache describes the content-addressed local store of downloaded executables and artifacts. Each blob is
+// downloaded only once and installed as a hard link into every instance which declares the same hash.
+type Cache struct {
+	// Retention is the time a blob is kept after it has been referenced for the last time, so that a rollback
+	// or a re-deployment does not need to download it again. Defaults to 7 days.
+	Retention time.Duration `json:"retention,omitempty"`
 }
 
 // Backup describes also the secrets to backup the data into. If a runner is removed or compromised, the backup
@@ -58,14 +135,21 @@ type Restore struct {
 	ApplyAfter time.Time `json:"applyAfter"`
 }
 
+// Generation identifies this restore configuration. Each generation is applied at most once successfully.
+func (r Restore) Generation() string {
+	return string(r.FileSet) + "@" + r.ApplyAfter.UTC().Format(time.RFC3339Nano)
+}
+
 // A Path for a file in whatever context it must be interpreted. Probably absolute in the sandbox for example
 // a root-based data dir like /data/mydata.tdb or /files/a/b/c.bin. A path containing '.' or '..' is invalid and will
 // be rejected.
 type Path string
 
 func (p Path) Validate() error {
-	if strings.Contains(string(p), ".") {
-		return errors.New("path cannot contain '.'")
+	for _, segment := range strings.Split(string(p), "/") {
+		if segment == "." || segment == ".." {
+			return errors.New("path cannot contain '.' or '..'")
+		}
 	}
 
 	return nil
@@ -74,6 +158,12 @@ func (p Path) Validate() error {
 // Sha3V512 represents the hex encoded sha3 512 hashsum.
 type Sha3V512 string
 
+// Valid returns true, if the hash consists of exactly 64 hex encoded bytes.
+func (h Sha3V512) Valid() bool {
+	buf, err := hex.DecodeString(string(h))
+	return err == nil && len(buf) == 64
+}
+
 type FileSetID string
 type FileSet struct {
 	// ID is unique for all file sets.
@@ -86,6 +176,46 @@ type FileSet struct {
 	Hash Sha3V512 `json:"hash,omitempty"`
 }
 
+// ComputeHash calculates the aggregate hash of all files, which must equal Hash. Each file contributes the line
+// "<hex hash> <decimal size>\n". The lines are sorted bytewise in ascending order, concatenated and hashed with
+// sha3 512, whose lower case hex encoding is the result. The paths do not contribute.
+func (s FileSet) ComputeHash() Sha3V512 {
+	lines := make([]string, 0, len(s.Files))
+	for _, file := range s.Files {
+		lines = append(lines, fmt.Sprintf("%s %d\n", file.Hash, file.Size))
+	}
+
+	slices.Sort(lines)
+
+	h := sha3.New512()
+	for _, line := range lines {
+		_, _ = h.Write([]byte(line))
+	}
+
+	return Sha3V512(hex.EncodeToString(h.Sum(nil)))
+}
+
+// Size returns the sum of all file sizes.
+func (s FileSet) Size() int64 {
+	var size int64
+	for _, file := range s.Files {
+		size += file.Size
+	}
+
+	return size
+}
+
+// Executable returns the first file which has the executable flag set.
+func (s FileSet) Executable() (File, bool) {
+	for _, file := range s.Files {
+		if file.Executable {
+			return file, true
+		}
+	}
+
+	return File{}, false
+}
+
 // A File must be a regular file and is never a hardlink or a softlink. It does not carry any permissions.
 // It is intended to be restored within the context of a sandbox.
 type File struct {
@@ -112,6 +242,252 @@ type Application struct {
 	Executable   Executable   `json:"executable"`
 	Build        Build        `json:"build,omitzero"`
 	ReverseProxy ReverseProxy `json:"reverseProxy,omitzero"`
+	Rollback     Rollback     `json:"rollback,omitzero"`
+	// Artifacts replace the single Executable, if they contain any files.
+	Artifacts Artifacts `json:"artifacts,omitzero"`
+	// Credentials are secrets which are passed to the service through systemd credentials instead of environment
+	// variables. See also Credential.
+	Credentials []Credential `json:"credentials,omitempty"`
+	// HealthCheck is probed periodically while the instance is declared.
+	HealthCheck HealthCheck `json:"healthCheck,omitzero"`
+	// Deployment describes how a changed instance is put into operation.
+	Deployment Deployment `json:"deployment,omitzero"`
+	// Jobs are periodic tasks like nightly reports, cache pruning or exports.
+	Jobs []Job `json:"jobs,omitempty"`
+	// Socket lets systemd hold the listening sockets of the instance.
+	Socket Socket `json:"socket,omitzero"`
+	// Replicas runs the instance multiple times behind a load balancing reverse proxy.
+	Replicas Replicas `json:"replicas,omitzero"`
+	// Dependencies on other instances of the same runner.
+	Dependencies []Dependency `json:"dependencies,omitempty"`
+	// DropIns override single settings of the generated unit, e.g. a temporary memory limit or an additional
+	// environment variable for debugging, without changing the declared Sandbox.
+	DropIns []DropIn `json:"dropIns,omitempty"`
+	// Slice is the name of a slice declared by the Runner, which limits the resources of this application together
+	// with the other applications of the slice.
+	Slice Name `json:"slice,omitempty"`
+}
+
+// DropIn is written to /etc/systemd/system/<inst>.service.d/<Name>.conf. The drop-ins of a blue/green deployed
+// or replicated instance are written to <inst>@.service.d instead, thus they apply to all slots or replicas.
+// Systemd merges the drop-ins into the unit in the alphabetical order of their names, see systemd.unit(5). Any
+// other drop-in in that directory is removed.
+type DropIn struct {
+	Name Name `json:"name"`
+	// Content in the unit file syntax including the section headers, e.g. "[Service]\nMemoryHigh=4G".
+	Content string `json:"content"`
+}
+
+// Dependency declares that the application needs another instance on the same runner. The instance is always
+// started after its dependencies and the dependencies must not form a cycle. Blue/green deployed instances cannot
+// be a dependency, because their unit changes with every deployment.
+type Dependency struct {
+	InstID string         `json:"instanceId"`
+	Kind   DependencyKind `json:"kind,omitempty"`
+}
+
+type DependencyKind string
+
+const (
+	// DependencyRequires starts the dependency together with the instance and stops or restarts the instance,
+	// whenever the dependency is stopped or restarted. This is the default.
+	DependencyRequires DependencyKind = "requires"
+	// DependencyWants starts the dependency together with the instance, but the instance is started anyway, if the
+	// dependency fails.
+	DependencyWants DependencyKind = "wants"
+	// DependencyBindsTo is like DependencyRequires, but also stops the instance, if the dependency stops
+	// unexpectedly.
+	DependencyBindsTo DependencyKind = "bindsTo"
+	// DependencyAfter only orders the start of the instance after the dependency, if both are started.
+	DependencyAfter DependencyKind = "after"
+)
+
+// Socket declares a socket unit <inst>.socket next to the service unit. Systemd listens on behalf of the
+// instance and passes the sockets to the service (see sd_listen_fds(3)), thus restarts do not lose any connections
+// and the service is only started on the first request. Socket activation cannot be combined with blue/green
+// deployments.
+type Socket struct {
+	// ListenStream declares stream sockets, e.g. 8080, 127.0.0.1:8080 or /run/my-app.sock.
+	ListenStream []string `json:"listenStream,omitempty"`
+	// ListenDatagram declares datagram sockets with the same syntax as ListenStream.
+	ListenDatagram []string `json:"listenDatagram,omitempty"`
+}
+
+// Declared returns true, if any socket has been declared.
+func (s Socket) Declared() bool {
+	return len(s.ListenStream) > 0 || len(s.ListenDatagram) > 0
+}
+
+// Job is a periodic task of an application. It becomes a oneshot service <inst>-job-<name>.service, which has the
+// same sandbox settings as the instance, and a timer <inst>-job-<name>.timer which triggers it.
+type Job struct {
+	Name Name `json:"name"`
+	// Command to execute, e.g. the executable of the instance with a sub command.
+	Command Command `json:"command"`
+	// OnCalendar defines when the job is triggered in the calendar event syntax of systemd.time(7), e.g.
+	// daily or *-*-* 03:00:00.
+	OnCalendar string `json:"onCalendar"`
+	// Persistent triggers a missed run immediately, e.g. if the machine was powered off at the scheduled time.
+	Persistent bool `json:"persistent,omitempty"`
+	// RandomizedDelay delays each run randomly up to the given duration, to avoid that all jobs start at once.
+	RandomizedDelay time.Duration `json:"randomizedDelay,omitempty"`
+}
+
+type Strategy string
+
+const (
+	// StrategyRestart stops the running service and starts the new version in place. The instance is unreachable
+	// until the new process is ready. This is the default.
+	StrategyRestart Strategy = "restart"
+	// StrategyBlueGreen starts the new version next to the running one and switches the reverse proxy, as soon
+	// as the new version is ready.
+	StrategyBlueGreen Strategy = "blueGreen"
+)
+
+type Deployment struct {
+	Strategy  Strategy  `json:"strategy,omitempty"`
+	BlueGreen BlueGreen `json:"blueGreen,omitzero"`
+}
+
+// BlueGreen runs the instance from a templated unit <inst>@.service in the two slots <inst>@blue and
+// <inst>@green, each on its own port. The reverse proxy rules of the application are rewritten to the port of the
+// active slot, thus their declared port is only used before the first deployment. Both slots share the same data
+// directory and run concurrently while the traffic is switched.
+type BlueGreen struct {
+	BluePort  int `json:"bluePort"`
+	GreenPort int `json:"greenPort"`
+	// PortEnv names the environment variable, which tells the application the port to listen on. Defaults to PORT.
+	PortEnv string `json:"portEnv,omitempty"`
+	// ReadinessPath is requested from the new slot by http and must respond with a 2xx status code, e.g. /health.
+	// If empty, the port of the new slot must just accept tcp connections.
+	ReadinessPath string `json:"readinessPath,omitempty"`
+	// Timeout for the new slot to become ready. Defaults to 60 seconds.
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// Drain is the time the former slot keeps running after the proxy has been switched, so that pending requests
+	// can complete. Defaults to 10 seconds.
+	Drain time.Duration `json:"drain,omitempty"`
+}
+
+// Replicas runs the instance from a templated unit <inst>@.service in the replicas <inst>@1 to <inst>@<Count>.
+// Replica i listens on BasePort+i-1 and, if a StateDirectory has been declared, gets the state directory
+// <StateDirectory>/<i> instead, thus the replicas never share their state. The reverse proxy rules of the application balance the load across all ready
+// replicas, thus their declared port is not used. Changed replicas are restarted one after another and are taken
+// out of the proxy meanwhile. Replicas cannot be combined with blue/green deployments or socket activation.
+type Replicas struct {
+	// Count of replicas. Zero disables replication and the instance runs from <inst>.service.
+	Count    int `json:"count,omitempty"`
+	BasePort int `json:"basePort,omitempty"`
+	// PortEnv names the environment variable, which tells the application the port to listen on. Defaults to PORT.
+	// The variable REPLICA contains the number of the replica.
+	PortEnv string `json:"portEnv,omitempty"`
+	// LoadBalancing is the lb_policy of caddy, e.g. round_robin, least_conn or ip_hash. Defaults to round_robin.
+	LoadBalancing string `json:"loadBalancing,omitempty"`
+	// ReadinessPath is requested from a started replica by http and must respond with a 2xx status code, e.g.
+	// /health. If empty, the port of the replica must just accept tcp connections.
+	ReadinessPath string `json:"readinessPath,omitempty"`
+	// Timeout for a started replica to become ready. Defaults to 60 seconds.
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// Drain is the time a replica keeps running after it has been taken out of the proxy, so that pending
+	// requests can complete. Defaults to 10 seconds.
+	Drain time.Duration `json:"drain,omitempty"`
+}
+
+// loadBalancingPolicies are the caddy lb_policy values, which do not require any arguments.
+var loadBalancingPolicies = []string{"random", "round_robin", "least_conn", "first", "ip_hash", "client_ip_hash", "uri_hash"}
+
+// Policy returns the declared load balancing policy or round_robin.
+func (r Replicas) Policy() string {
+	if r.LoadBalancing == "" {
+		return "round_robin"
+	}
+
+	return r.LoadBalancing
+}
+
+// Validate checks the replica count, the port range and the load balancing policy.
+func (r Replicas) Validate() error {
+	if r.Count < 0 {
+		return fmt.Errorf("invalid replica count: %d", r.Count)
+	}
+
+	if r.BasePort <= 0 || r.BasePort+r.Count-1 > 65535 {
+		return fmt.Errorf("invalid replica port range: %d-%d", r.BasePort, r.BasePort+r.Count-1)
+	}
+
+	if !slices.Contains(loadBalancingPolicies, r.Policy()) {
+		return fmt.Errorf("unsupported load balancing policy: %q", r.LoadBalancing)
+	}
+
+	return nil
+}
+
+// Redacted returns a copy without any secret values, e.g. to be stored in world-readable files. The names of the
+// credentials are kept.
+func (a Application) Redacted() Application {
+	a.Backup.S3.AccessKey = ""
+	a.Backup.S3.SecretKey = ""
+	a.Artifacts.S3.AccessKey = ""
+	a.Artifacts.S3.SecretKey = ""
+	a.Build.Git.SSHPrivateKey = ""
+	if a.Credentials != nil {
+		creds := make([]Credential, 0, len(a.Credentials))
+		for _, c := range a.Credentials {
+			creds = append(creds, Credential{Name: c.Name})
+		}
+		a.Credentials = creds
+	}
+
+	return a
+}
+
+// Credential is a secret, which the runner writes into a root-only file, encrypted by systemd-creds if available.
+// The unit references it through LoadCredential= or LoadCredentialEncrypted=, so that the service process can read
+// the value from $CREDENTIALS_DIRECTORY/<Name>. The value never appears in the unit file.
+type Credential struct {
+	// Name is the credential identifier, e.g. db-password.
+	Name  Name   `json:"name"`
+	Value string `json:"value,omitempty"`
+}
+
+// Rollback describes how an updated executable or unit file is verified after the service has been restarted.
+// If the service does not become healthy within the GracePeriod, the previous executable and unit file are
+// put back automatically.
+type Rollback struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// GracePeriod to watch the restarted service. Defaults to 30 seconds.
+	GracePeriod time.Duration `json:"gracePeriod,omitempty"`
+	// Readiness is optional and must succeed at least once within the grace period.
+	Readiness Probe `json:"readiness,omitzero"`
+}
+
+// Probe describes a local check, whether an application actually serves requests. Exactly one of HTTP, TCP or
+// Exec should be declared, otherwise the first declared one in that order is used.
+type Probe struct {
+	// HTTP is an url like http://localhost:8080/health which must respond with a 2xx status code.
+	HTTP URL `json:"http,omitempty"`
+	// TCP is an address like localhost:8080 which must accept a connection.
+	TCP string `json:"tcp,omitempty"`
+	// Exec is a command which must exit with status 0. It is executed on the host with the privileges of the runner.
+	Exec Command `json:"exec,omitzero"`
+	// Timeout of a single probe. Defaults to 5 seconds.
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// Declared returns true, if any check has been declared.
+func (p Probe) Declared() bool {
+	return p.HTTP != "" || p.TCP != "" || p.Exec.Cmd != ""
+}
+
+// HealthCheck describes a probe, which is executed periodically by the runner. Any change of the health state of
+// the instance is reported to the hub.
+type HealthCheck struct {
+	Enabled bool  `json:"enabled,omitempty"`
+	Probe   Probe `json:"probe"`
+	// Interval between two probes. Defaults to 10 seconds.
+	Interval time.Duration `json:"interval,omitempty"`
+	// FailureThreshold is the amount of consecutive failed probes, after which the instance is considered
+	// unhealthy. Defaults to 3.
+	FailureThreshold int `json:"failureThreshold,omitempty"`
 }
 
 type ReverseProxy struct {
@@ -129,8 +505,27 @@ type Rule struct {
 	RedirectTarget string `json:"redirectTarget,omitempty"`
 }
 
+// Domain is a host name like myapp.com. The leftmost label may be a wildcard like *.myapp.com.
 type Domain string
 
+var domainLabelRegex = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// Valid returns true, if the domain consists of valid labels and does not exceed 253 characters.
+func (d Domain) Valid() bool {
+	s := strings.TrimPrefix(string(d), "*.")
+	if s == "" || len(s) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(s, ".") {
+		if !domainLabelRegex.MatchString(label) {
+			return false
+		}
+	}
+
+	return true
+}
+
 type Build struct {
 	Enabled bool   `json:"enabled,omitempty"`
 	Git     Git    `json:"git,omitempty"`
@@ -153,6 +548,9 @@ type Git struct {
 	Branch        string `json:"branch,omitempty"` // e.g. main
 	SSHPrivateKey string `json:"sshPrivateKey,omitempty"`
 	SSHPublicKey  string `json:"sshPublicKey,omitempty"`
+	// KnownHosts contains the host keys of the repository server in the known_hosts format, e.g. the output of
+	// ssh-keyscan. It is required, because an unknown host key is never trusted.
+	KnownHosts string `json:"knownHosts,omitempty"`
 }
 
 // Artifacts from a build which contains at least a single executable file. The actual file data can be obtained
@@ -173,7 +571,9 @@ type Sandbox struct {
 type Filesystem struct {
 	Enabled bool `json:"enabled,omitempty"`
 	// Maximum amount of usable persistent disk space in the context (e.g. a sandbox). This requires
-	// a filesystem which supports usrquota,grpquota. Value will be set through setquota.
+	// a filesystem which supports usrquota,grpquota. Value will be set through setquota. The quota belongs to the
+	// static User= of the service, thus it cannot be combined with DynamicUser=, whose user id may change on each
+	// start.
 	UsrQuota Memory `json:"max"`
 }
 
@@ -186,8 +586,8 @@ func (n Name) Valid() bool {
 }
 
 // ServiceUnit contains all declarative systemd service sections. See also
-// https://www.freedesktop.org/software/systemd/man/latest/systemd.resource-control.html
-// and do not forget to audit sandboxing score by systemd-analyze security .
+// https://www.freedesktop.org/software/systemd/man/latest/systemd.resource-control.html.
+// The sandboxing score is audited by systemd-analyze security after each apply, see also Security.
 type ServiceUnit struct {
 	Unit    UnitSection    `json:"unit"`
 	Install InstallSection `json:"install"`
@@ -203,6 +603,13 @@ type UnitSection struct {
 	Description string `json:"description,omitempty"`
 	// e.g. "network-online.target"
 	After Name `json:"after,omitempty"`
+	// AfterUnits are started before this unit like After, but allow any number of units.
+	AfterUnits []Name `json:"afterUnits,omitempty"`
+	// Requires, Wants and BindsTo declare dependencies on other units as described by systemd.unit(5). The
+	// Dependencies of an Application are added here by the runner.
+	Requires []Name `json:"requires,omitempty"`
+	Wants    []Name `json:"wants,omitempty"`
+	BindsTo  []Name `json:"bindsTo,omitempty"`
 }
 
 // BindRule configures restrictions on the ability of unit processes to invoke bind(2) on a socket.
@@ -221,7 +628,7 @@ type ProtectControlGroups string
 
 type RestrictNamespaces string
 
-// yes, "full" or "strict"
+// "yes", "no", "full" or "strict"
 type ProtectSystem string
 
 // yes, "read-only" or "tmpfs".
@@ -394,6 +801,18 @@ type ServiceSection struct {
 	// data to unit processes securely.
 	Environment []EnvVar `json:"environment,omitempty"`
 
+	// EnvironmentFile reads environment variables from a file, which override the Environment entries. A leading
+	// dash ignores a missing file. Specifiers like %i are expanded by systemd.
+	EnvironmentFile []string `json:"environmentFile,omitempty"`
+
+	// LoadCredential passes a plaintext credential file to the service, declared as ID:PATH. Entries for the
+	// Application.Credentials are added by the runner.
+	LoadCredential []string `json:"loadCredential,omitempty"`
+
+	// LoadCredentialEncrypted is like LoadCredential but the file has been encrypted by systemd-creds and is
+	// decrypted by systemd before the service starts.
+	LoadCredentialEncrypted []string `json:"loadCredentialEncrypted,omitempty"`
+
 	// Takes a boolean argument or the special values "full" or "strict". If true, mounts the /usr/ and the boot
 	// loader directories (/boot and /efi) read-only for processes invoked by this unit. If set to "full", the
 	// /etc/ directory is mounted read-only, too. If set to "strict" the entire file system hierarchy is mounted
@@ -482,6 +901,21 @@ type ServiceSection struct {
 	// Commands that are executed when this service is started.
 	ExecStart Command `json:"execStart"`
 
+	// Commands that are executed one after another before ExecStart, e.g. a database migration or a warm-up. If
+	// any of them fails, the service is not started and the failure is reported as the error of the instance.
+	ExecStartPre []Command `json:"execStartPre,omitempty"`
+
+	// Commands that are executed one after another after ExecStart has been started. For Type=notify or
+	// Type=exec, they run once the service is ready.
+	ExecStartPost []Command `json:"execStartPost,omitempty"`
+
+	// Commands to stop the service. Afterwards, the remaining processes are killed according to KillMode. If
+	// empty, the processes are just killed with KillSignal.
+	ExecStop []Command `json:"execStop,omitempty"`
+
+	// Commands that are executed to reload the configuration of the service, e.g. by systemctl reload.
+	ExecReload []Command `json:"execReload,omitempty"`
+
 	// Configures the time to sleep before restarting a service (as configured with Restart=).
 	// Takes a unit-less value in seconds, or a time span value such as "5min 20s". Defaults to 100ms.
 	RestartSec time.Duration `json:"restartSec,omitempty"`
@@ -609,6 +1043,30 @@ type ServiceSection struct {
 	// Example: CPUQuota=20% ensures that the executed processes will never get more than 20% CPU time on one CPU.
 	CPUQuota int `json:"CPUQuota,omitempty"`
 
+	// MemoryMax is the hard limit of the memory usage. If the processes exceed it, the OOM killer is invoked, thus
+	// MemoryHigh should be used to throttle the processes before. The effective limit is lower, if the slice of the
+	// unit has a lower limit.
+	MemoryMax Memory `json:"memoryMax,omitempty"`
+
+	// TasksMax limits the number of processes and threads, e.g. to survive a fork bomb. Zero applies the
+	// DefaultTasksMax= of systemd-system.conf(5).
+	TasksMax int `json:"tasksMax,omitempty"`
+
+	// IOWeight is the relative block IO weight between 1 and 10000. The kernel default is 100.
+	IOWeight int `json:"IOWeight,omitempty"`
+
+	// IOReadBandwidthMax and IOWriteBandwidthMax limit the bandwidth per block device, see IOBandwidth.
+	IOReadBandwidthMax  []IOBandwidth `json:"IOReadBandwidthMax,omitempty"`
+	IOWriteBandwidthMax []IOBandwidth `json:"IOWriteBandwidthMax,omitempty"`
+
+	// LimitNOFILE is the maximum number of open file descriptors, either a single value for the soft and the hard
+	// limit or soft:hard, e.g. 65536 or 1024:524288. The special value infinity disables the limit.
+	LimitNOFILE string `json:"limitNOFILE,omitempty"`
+
+	// CPUAffinity restricts the processes to the given CPUs or ranges of CPUs, separated by spaces or commas,
+	// e.g. 0-3 or 0,2,4.
+	CPUAffinity string `json:"CPUAffinity,omitempty"`
+
 	// Specifies how processes of this unit shall be killed. One of control-group, mixed, process, none.
 	// If set to control-group, all remaining processes in the control group of this unit will be killed on unit stop
 	// (for services: after the stop command is executed, as configured with ExecStop=). If set to mixed, the SIGTERM
@@ -637,8 +1095,16 @@ type ServiceSection struct {
 	// to stop. If it doesn't terminate in the specified time, it will be forcibly terminated by SIGKILL
 	// (see KillMode= in systemd.kill(5)).
 	TimeoutStopSec time.Duration `json:"timeoutStopSec,omitempty"`
+
+	// Slice is the unit name of the slice to run the processes in, e.g. ngr-acme.slice. Defaults to system.slice.
+	// The slice of an Application is set here by the runner, see also Application.Slice.
+	Slice string `json:"slice,omitempty"`
 }
 
+// IOBandwidth is the path of a block device or of a file on it followed by the bandwidth in bytes per second,
+// e.g. "/dev/sda 50M" or "/var/lib 10M". The suffixes K, M, G and T are parsed with the base 1000.
+type IOBandwidth string
+
 // KillSignal is one of the standard signals like SIGKILL, SIGTERM etc
 type KillSignal string
 
@@ -649,6 +1115,40 @@ type KillMode string
 // as Kilobytes, Megabytes, Gigabytes, or Terabytes (with the base 1024), respectively.
 type Memory string
 
+// Bytes parses the absolute memory size. The special value "infinity" returns -1. Percentages are
+// relative to the machine and cannot be resolved here, thus they are rejected.
+func (m Memory) Bytes() (int64, error) {
+	s := strings.TrimSpace(string(m))
+	if s == "infinity" {
+		return -1, nil
+	}
+
+	factor := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			factor = 1 << 10
+		case 'M':
+			factor = 1 << 20
+		case 'G':
+			factor = 1 << 30
+		case 'T':
+			factor = 1 << 40
+		}
+	}
+
+	if factor != 1 {
+		s = s[:len(s)-1]
+	}
+
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid memory size: %q", string(m))
+	}
+
+	return v * factor, nil
+}
+
 type URL string
 
 type Command struct {
@@ -0,0 +1,446 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package configuration
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	restarts       = []Restart{"no", "on-success", "on-failure", "on-abnormal", "on-watchdog", "on-abort", "always"}
+	types          = []Type{"simple", "exec", "forking", "oneshot", "dbus", "notify", "notify-reload", "idle"}
+	protectProcs   = []ProtectProc{"noaccess", "invisible", "ptraceable", "default"}
+	protectSystems = []ProtectSystem{"yes", "no", "full", "strict"}
+	oomPolicies    = []OOMPolicy{"continue", "stop", "kill"}
+	dependencies   = []DependencyKind{DependencyRequires, DependencyWants, DependencyBindsTo, DependencyAfter}
+)
+
+// envKeyRegex matches the portable names of environment variables, which every shell and runtime accepts.
+var envKeyRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Problem is a single invalid value of a configuration.
+type Problem struct {
+	// Path is the JSON path of the offending field, e.g. applications[2].sandbox.systemd.service.restart.
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	return p.Path + ": " + p.Message
+}
+
+// ValidationError contains all problems found in a configuration.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		lines = append(lines, p.String())
+	}
+
+	return fmt.Sprintf("invalid configuration: %d problems:\n%s", len(e.Problems), strings.Join(lines, "\n"))
+}
+
+// validator collects the problems of a configuration.
+type validator struct {
+	problems []Problem
+}
+
+func (v *validator) report(path string, format string, args ...any) {
+	v.problems = append(v.problems, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) check(path string, err error) {
+	if err != nil {
+		v.report(path, "%s", err.Error())
+	}
+}
+
+func enum[T ~string](v *validator, path string, value T, allowed []T) {
+	if value != "" && !slices.Contains(allowed, value) {
+		v.report(path, "unsupported value %q, expected one of %v", value, allowed)
+	}
+}
+
+// Validate checks the entire configuration and returns a *ValidationError with every problem found or nil.
+// A configuration which does not validate must be rejected as a whole and never be applied partially.
+func (r Runner) Validate() error {
+	var v validator
+	seen := map[string]int{}
+	for i, app := range r.Applications {
+		path := fmt.Sprintf("applications[%d]", i)
+		switch j, ok := seen[app.InstID]; {
+		case app.InstID == "":
+			v.report(path+".instanceId", "instance id is required")
+		case ok:
+			v.report(path+".instanceId", "duplicate instance id %q, already declared by applications[%d]", app.InstID, j)
+		case !Name(app.InstID).Valid():
+			v.report(path+".instanceId", "invalid instance id %q", app.InstID)
+		default:
+			seen[app.InstID] = i
+		}
+
+		app.validate(&v, path)
+		if app.Slice != "" && !slices.ContainsFunc(r.Slices, func(slice Slice) bool { return slice.Name == app.Slice }) {
+			v.report(path+".slice", "slice %q is not declared", app.Slice)
+		}
+	}
+
+	sliceNames := map[Name]bool{}
+	for i, slice := range r.Slices {
+		path := fmt.Sprintf("slices[%d]", i)
+		switch {
+		case !slice.Name.Valid():
+			v.report(path+".name", "invalid slice name %q", slice.Name)
+		case strings.Contains(string(slice.Name), "-"):
+			v.report(path+".name", "slice name %q must not contain a dash, which nests slices", slice.Name)
+		case sliceNames[slice.Name]:
+			v.report(path+".name", "duplicate slice name %q", slice.Name)
+		}
+
+		sliceNames[slice.Name] = true
+		slice.validate(&v, path)
+	}
+
+	r.validateDependencies(&v)
+
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+
+	return nil
+}
+
+func (a Application) validate(v *validator, path string) {
+	a.Sandbox.Unit.Service.validate(v, path+".sandbox.systemd.service")
+
+	if a.Sandbox.Filesystem.Enabled {
+		if _, err := a.Sandbox.Filesystem.UsrQuota.Bytes(); err != nil {
+			v.report(path+".sandbox.filesystem.max", "%s", err.Error())
+		}
+
+		switch service := a.Sandbox.Unit.Service; {
+		case service.DynamicUser:
+			v.report(path+".sandbox.filesystem.enabled", "disk quota cannot be combined with a dynamic user")
+		case service.User == "":
+			v.report(path+".sandbox.filesystem.enabled", "disk quota requires a static user")
+		}
+	}
+
+	if a.Build.Enabled && strings.TrimSpace(a.Build.Git.KnownHosts) == "" {
+		v.report(path+".build.git.knownHosts", "known hosts of the repository are required")
+	}
+
+	// the values are passed to git and go as arguments, which must never be taken for options
+	if a.Build.Enabled {
+		for _, arg := range []struct{ field, value string }{
+			{".build.git.url", a.Build.Git.URL},
+			{".build.git.branch", a.Build.Git.Branch},
+			{".build.pureGo.mainPkg", a.Build.PureGo.MainPkg},
+		} {
+			if strings.HasPrefix(arg.value, "-") {
+				v.report(path+arg.field, "must not start with a dash: %q", arg.value)
+			}
+		}
+	}
+
+	if len(a.Artifacts.FileSet.Files) > 0 && !a.Artifacts.FileSet.Hash.Valid() {
+		v.report(path+".artifacts.fileSet.hash", "invalid hash %q", a.Artifacts.FileSet.Hash)
+	}
+
+	for i, file := range a.Artifacts.FileSet.Files {
+		fpath := fmt.Sprintf("%s.artifacts.fileSet.files[%d]", path, i)
+		v.check(fpath+".path", file.Path.Validate())
+		if !file.Hash.Valid() {
+			v.report(fpath+".hash", "invalid hash %q", file.Hash)
+		}
+	}
+
+	for i, rule := range a.ReverseProxy.Rules {
+		if rule.Location != "" && !rule.Location.Valid() {
+			v.report(fmt.Sprintf("%s.reverseProxy.rules[%d].location", path, i), "invalid domain %q", rule.Location)
+		}
+	}
+
+	for i, cred := range a.Credentials {
+		if !cred.Name.Valid() {
+			v.report(fmt.Sprintf("%s.credentials[%d].name", path, i), "invalid credential name %q", cred.Name)
+		}
+	}
+
+	for i, job := range a.Jobs {
+		if !job.Name.Valid() {
+			v.report(fmt.Sprintf("%s.jobs[%d].name", path, i), "invalid job name %q", job.Name)
+		}
+	}
+
+	dropIns := map[Name]bool{}
+	for i, dropIn := range a.DropIns {
+		dpath := fmt.Sprintf("%s.dropIns[%d]", path, i)
+		switch {
+		case !dropIn.Name.Valid():
+			v.report(dpath+".name", "invalid drop-in name %q", dropIn.Name)
+		case dropIns[dropIn.Name]:
+			v.report(dpath+".name", "duplicate drop-in name %q", dropIn.Name)
+		}
+
+		if strings.TrimSpace(dropIn.Content) == "" {
+			v.report(dpath+".content", "drop-in content is required")
+		}
+
+		dropIns[dropIn.Name] = true
+	}
+
+	if a.Replicas.Count != 0 {
+		v.check(path+".replicas", a.Replicas.Validate())
+		if a.Deployment.Strategy == StrategyBlueGreen {
+			v.report(path+".replicas", "replicas cannot be combined with blue/green deployments")
+		}
+
+		if a.Socket.Declared() {
+			v.report(path+".replicas", "replicas cannot be combined with socket activation")
+		}
+	}
+}
+
+// validateDependencies checks that every dependency refers to another declared instance, which is not deployed
+// blue/green, and that the dependencies do not form a cycle.
+func (r Runner) validateDependencies(v *validator) {
+	apps := map[string]Application{}
+	for _, app := range r.Applications {
+		apps[app.InstID] = app
+	}
+
+	for i, app := range r.Applications {
+		for j, dep := range app.Dependencies {
+			path := fmt.Sprintf("applications[%d].dependencies[%d]", i, j)
+			enum(v, path+".kind", dep.Kind, dependencies)
+			switch target, ok := apps[dep.InstID]; {
+			case !ok:
+				v.report(path+".instanceId", "dependency %q is not declared", dep.InstID)
+			case target.Deployment.Strategy == StrategyBlueGreen:
+				v.report(path+".instanceId", "dependency %q is deployed blue/green", dep.InstID)
+			}
+		}
+	}
+
+	if cycle := findCycle(r.Applications); cycle != nil {
+		i := slices.IndexFunc(r.Applications, func(app Application) bool { return app.InstID == cycle[0] })
+		v.report(fmt.Sprintf("applications[%d].dependencies", i), "dependency cycle: %s", strings.Join(cycle, " -> "))
+	}
+}
+
+// findCycle returns the instances of the first dependency cycle like a -> b -> a or nil, if there is none.
+func findCycle(apps []Application) []string {
+	deps := map[string][]string{}
+	for _, app := range apps {
+		for _, dep := range app.Dependencies {
+			deps[app.InstID] = append(deps[app.InstID], dep.InstID)
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := map[string]int{}
+	var path []string
+	var visit func(instID string) []string
+	visit = func(instID string) []string {
+		switch state[instID] {
+		case visiting:
+			start := slices.Index(path, instID)
+			return append(slices.Clone(path[start:]), instID)
+		case visited:
+			return nil
+		}
+
+		state[instID] = visiting
+		path = append(path, instID)
+		for _, dep := range deps[instID] {
+			if cycle := visit(dep); cycle != nil {
+				return cycle
+			}
+		}
+
+		path = path[:len(path)-1]
+		state[instID] = visited
+		return nil
+	}
+
+	for _, app := range apps {
+		if cycle := visit(app.InstID); cycle != nil {
+			return cycle
+		}
+	}
+
+	return nil
+}
+
+func (s ServiceSection) validate(v *validator, path string) {
+	enum(v, path+".restart", s.Restart, restarts)
+	enum(v, path+".type", s.Type, types)
+	enum(v, path+".protectProc", s.ProtectProc, protectProcs)
+	enum(v, path+".protectSystem", s.ProtectSystem, protectSystems)
+	enum(v, path+".OOMPolicy", s.OOMPolicy, oomPolicies)
+
+	v.check(path+".memoryHigh", s.MemoryHigh.Validate())
+	v.check(path+".startupMemoryHigh", s.StartupMemoryHigh.Validate())
+	v.check(path+".memorySwapMax", s.MemorySwapMax.Validate())
+	v.check(path+".startupMemorySwapMax", s.StartupMemorySwapMax.Validate())
+	v.check(path+".memoryMax", s.MemoryMax.Validate())
+
+	validateTasksMax(v, path+".tasksMax", s.TasksMax)
+	validateIOWeight(v, path+".IOWeight", s.IOWeight)
+	for i, bw := range s.IOReadBandwidthMax {
+		v.check(fmt.Sprintf("%s.IOReadBandwidthMax[%d]", path, i), validateIOBandwidth(bw))
+	}
+
+	for i, bw := range s.IOWriteBandwidthMax {
+		v.check(fmt.Sprintf("%s.IOWriteBandwidthMax[%d]", path, i), validateIOBandwidth(bw))
+	}
+
+	v.check(path+".limitNOFILE", validateLimitNOFILE(s.LimitNOFILE))
+	v.check(path+".CPUAffinity", validateCPUAffinity(s.CPUAffinity))
+
+	for i, env := range s.Environment {
+		if !envKeyRegex.MatchString(env.Key) {
+			v.report(fmt.Sprintf("%s.environment[%d].key", path, i), "invalid variable name %q", env.Key)
+		}
+	}
+
+	v.check(path+".bindPaths", validateBindPaths(s.BindPaths))
+	v.check(path+".bindReadOnlyPaths", validateBindPaths(s.BindReadOnlyPaths))
+}
+
+func (s Slice) validate(v *validator, path string) {
+	v.check(path+".memoryMax", s.MemoryMax.Validate())
+	if s.CPUQuota < 0 {
+		v.report(path+".CPUQuota", "invalid CPU quota %d", s.CPUQuota)
+	}
+
+	validateIOWeight(v, path+".IOWeight", s.IOWeight)
+	validateTasksMax(v, path+".tasksMax", s.TasksMax)
+}
+
+func validateIOWeight(v *validator, path string, weight int) {
+	if weight != 0 && (weight < 1 || weight > 10000) {
+		v.report(path, "IO weight %d is not between 1 and 10000", weight)
+	}
+}
+
+func validateTasksMax(v *validator, path string, tasks int) {
+	if tasks < 0 {
+		v.report(path, "invalid maximum number of tasks %d", tasks)
+	}
+}
+
+// validateIOBandwidth checks an absolute path followed by a bandwidth like 50M.
+func validateIOBandwidth(bw IOBandwidth) error {
+	p, rate, ok := strings.Cut(string(bw), " ")
+	if !ok || !filepath.IsAbs(p) {
+		return fmt.Errorf("invalid IO bandwidth %q, expected an absolute path and a bandwidth", bw)
+	}
+
+	if _, err := Memory(strings.TrimSpace(rate)).Bytes(); err != nil {
+		return fmt.Errorf("invalid IO bandwidth %q: %w", bw, err)
+	}
+
+	return nil
+}
+
+// validateLimitNOFILE checks a single limit or soft:hard, where each limit is a number or infinity.
+func validateLimitNOFILE(s string) error {
+	if s == "" {
+		return nil
+	}
+
+	for _, limit := range strings.SplitN(s, ":", 2) {
+		if limit == "infinity" {
+			continue
+		}
+
+		if n, err := strconv.ParseUint(limit, 10, 64); err != nil || n == 0 {
+			return fmt.Errorf("invalid file descriptor limit %q", s)
+		}
+	}
+
+	return nil
+}
+
+// validateCPUAffinity checks a list of CPU indices or ranges like 0-3, separated by spaces or commas.
+func validateCPUAffinity(s string) error {
+	for _, cpus := range strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == ',' }) {
+		first, last, isRange := strings.Cut(cpus, "-")
+		lo, err := strconv.ParseUint(first, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid CPU %q", cpus)
+		}
+
+		if isRange {
+			hi, err := strconv.ParseUint(last, 10, 32)
+			if err != nil || hi < lo {
+				return fmt.Errorf("invalid CPU range %q", cpus)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateBindPaths checks a space separated list of [-]SOURCE[:DESTINATION[:OPTIONS]], whose paths must be
+// absolute. See also BindPaths= in systemd.exec(5).
+func validateBindPaths(s string) error {
+	for _, entry := range strings.Fields(s) {
+		parts := strings.Split(strings.TrimPrefix(entry, "-"), ":")
+		if len(parts) > 3 {
+			return fmt.Errorf("invalid bind path %q", entry)
+		}
+
+		for _, p := range parts[:min(len(parts), 2)] {
+			if !filepath.IsAbs(p) {
+				return fmt.Errorf("bind path must be absolute: %q", entry)
+			}
+		}
+
+		if len(parts) == 3 && parts[2] != "rbind" && parts[2] != "norbind" {
+			return fmt.Errorf("unsupported bind option %q", parts[2])
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the syntax of the memory size. In addition to Bytes, a percentage like 80% of the machine
+// is accepted.
+func (m Memory) Validate() error {
+	if m == "" {
+		return nil
+	}
+
+	if s, ok := strings.CutSuffix(strings.TrimSpace(string(m)), "%"); ok {
+		p, err := strconv.ParseFloat(s, 64)
+		if err != nil || p < 0 || p > 100 {
+			return fmt.Errorf("invalid memory percentage: %q", string(m))
+		}
+
+		return nil
+	}
+
+	_, err := m.Bytes()
+	return err
+}
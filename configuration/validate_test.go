@@ -0,0 +1,236 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package configuration
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	app := func(id string, deps ...string) Application {
+		a := Application{InstID: id}
+		for _, dep := range deps {
+			a.Dependencies = append(a.Dependencies, Dependency{InstID: dep})
+		}
+
+		return a
+	}
+
+	blueGreen := app("green")
+	blueGreen.Deployment.Strategy = StrategyBlueGreen
+
+	restart := app("a")
+	restart.Sandbox.Unit.Service.Restart = "sometimes"
+
+	sliced := app("a")
+	sliced.Slice = "acme"
+
+	kind := app("a", "b")
+	kind.Dependencies[0].Kind = "needs"
+
+	replicated := app("a")
+	replicated.Replicas = Replicas{Count: 2, BasePort: 8000}
+	replicated.Deployment.Strategy = StrategyBlueGreen
+
+	socket := app("a")
+	socket.Replicas = Replicas{Count: 2, BasePort: 8000}
+	socket.Socket.ListenStream = []string{"8080"}
+
+	quota := app("a")
+	quota.Sandbox.Filesystem = Filesystem{Enabled: true, UsrQuota: "1G"}
+	quota.Sandbox.Unit.Service.DynamicUser = true
+
+	build := app("a")
+	build.Build.Enabled = true
+
+	option := build
+	option.Build.Git.KnownHosts = "example.com ssh-ed25519 AAAA"
+	option.Build.Git.URL = "--upload-pack=touch /tmp/pwned"
+	option.Build.PureGo.MainPkg = "-toolexec=sh"
+
+	env := app("a")
+	env.Sandbox.Unit.Service.Environment = []EnvVar{{Key: "OK", Value: "$ % \" \n"}, {Key: "NOT-OK"}}
+
+	tests := []struct {
+		name  string
+		cfg   Runner
+		paths []string
+	}{
+		{
+			name: "valid",
+			cfg:  Runner{Applications: []Application{app("web", "db"), app("db")}},
+		},
+		{
+			name:  "missing instance id",
+			cfg:   Runner{Applications: []Application{app("")}},
+			paths: []string{"applications[0].instanceId"},
+		},
+		{
+			name:  "duplicate instance id",
+			cfg:   Runner{Applications: []Application{app("a"), app("a")}},
+			paths: []string{"applications[1].instanceId"},
+		},
+		{
+			name:  "unsupported restart",
+			cfg:   Runner{Applications: []Application{restart}},
+			paths: []string{"applications[0].sandbox.systemd.service.restart"},
+		},
+		{
+			name:  "invalid environment key",
+			cfg:   Runner{Applications: []Application{env}},
+			paths: []string{"applications[0].sandbox.systemd.service.environment[1].key"},
+		},
+		{
+			name:  "undeclared slice",
+			cfg:   Runner{Applications: []Application{sliced}},
+			paths: []string{"applications[0].slice"},
+		},
+		{
+			name:  "slice name with dash",
+			cfg:   Runner{Slices: []Slice{{Name: "acme-eu"}}},
+			paths: []string{"slices[0].name"},
+		},
+		{
+			name:  "duplicate slice",
+			cfg:   Runner{Slices: []Slice{{Name: "acme"}, {Name: "acme"}}},
+			paths: []string{"slices[1].name"},
+		},
+		{
+			name:  "undeclared dependency",
+			cfg:   Runner{Applications: []Application{app("a", "missing")}},
+			paths: []string{"applications[0].dependencies[0].instanceId"},
+		},
+		{
+			name:  "unsupported dependency kind",
+			cfg:   Runner{Applications: []Application{kind, app("b")}},
+			paths: []string{"applications[0].dependencies[0].kind"},
+		},
+		{
+			name:  "blue/green dependency",
+			cfg:   Runner{Applications: []Application{app("a", "green"), blueGreen}},
+			paths: []string{"applications[0].dependencies[0].instanceId"},
+		},
+		{
+			name:  "dependency cycle",
+			cfg:   Runner{Applications: []Application{app("a"), app("b", "c"), app("c", "b")}},
+			paths: []string{"applications[1].dependencies"},
+		},
+		{
+			name:  "self dependency",
+			cfg:   Runner{Applications: []Application{app("a", "a")}},
+			paths: []string{"applications[0].dependencies"},
+		},
+		{
+			name:  "replicas with blue/green",
+			cfg:   Runner{Applications: []Application{replicated}},
+			paths: []string{"applications[0].replicas"},
+		},
+		{
+			name:  "replicas with socket",
+			cfg:   Runner{Applications: []Application{socket}},
+			paths: []string{"applications[0].replicas"},
+		},
+		{
+			name:  "quota with dynamic user",
+			cfg:   Runner{Applications: []Application{quota}},
+			paths: []string{"applications[0].sandbox.filesystem.enabled"},
+		},
+		{
+			name:  "build without known hosts",
+			cfg:   Runner{Applications: []Application{build}},
+			paths: []string{"applications[0].build.git.knownHosts"},
+		},
+		{
+			name:  "build arguments as options",
+			cfg:   Runner{Applications: []Application{option}},
+			paths: []string{"applications[0].build.git.url", "applications[0].build.pureGo.mainPkg"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			if len(tt.paths) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				return
+			}
+
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("expected a *ValidationError, got %v", err)
+			}
+
+			var got []string
+			for _, p := range verr.Problems {
+				got = append(got, p.Path)
+			}
+
+			if !slices.Equal(got, tt.paths) {
+				t.Fatalf("got paths %v, want %v", got, tt.paths)
+			}
+		})
+	}
+}
+
+func TestFindCycle(t *testing.T) {
+	app := func(id string, deps ...string) Application {
+		a := Application{InstID: id}
+		for _, dep := range deps {
+			a.Dependencies = append(a.Dependencies, Dependency{InstID: dep})
+		}
+
+		return a
+	}
+
+	tests := []struct {
+		name string
+		apps []Application
+		want []string
+	}{
+		{
+			name: "no dependencies",
+			apps: []Application{app("a"), app("b")},
+		},
+		{
+			name: "diamond",
+			apps: []Application{app("a", "b", "c"), app("b", "d"), app("c", "d"), app("d")},
+		},
+		{
+			name: "undeclared dependency",
+			apps: []Application{app("a", "missing")},
+		},
+		{
+			name: "self",
+			apps: []Application{app("a", "a")},
+			want: []string{"a", "a"},
+		},
+		{
+			name: "pair",
+			apps: []Application{app("a", "b"), app("b", "a")},
+			want: []string{"a", "b", "a"},
+		},
+		{
+			name: "behind a chain",
+			apps: []Application{app("a", "b"), app("b", "c"), app("c", "d"), app("d", "b")},
+			want: []string{"b", "c", "d", "b"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findCycle(tt.apps); !slices.Equal(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
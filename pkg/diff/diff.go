@@ -0,0 +1,190 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+// Package diff provides a minimal line based textual diff, good enough to show pending changes of generated
+// configuration files to a human.
+package diff
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const contextLines = 3
+
+// noNewline is appended to the last line of a text without a trailing line break. Thus, such a line differs from
+// the same line with a line break and the marker is written right after it.
+const noNewline = "\n\\ No newline at end of file"
+
+type op struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+// Unified returns a unified diff between the old text a and the new text b. The names are used for the
+// header lines. If both texts are equal, the empty string is returned.
+func Unified(aName, bName string, a, b string) string {
+	if a == b {
+		return ""
+	}
+
+	ops := lines(splitLines(a), splitLines(b))
+
+	var sb strings.Builder
+	sb.WriteString("--- " + aName + "\n")
+	sb.WriteString("+++ " + bName + "\n")
+
+	// group changes into hunks surrounded by a bit of context
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+
+		start := max(0, i-contextLines)
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+
+			// look ahead, if the next change is close enough to merge the hunks
+			next := end
+			for next < len(ops) && ops[next].kind == ' ' {
+				next++
+			}
+
+			if next < len(ops) && next-end <= 2*contextLines {
+				end = next
+				continue
+			}
+
+			end = min(len(ops), end+contextLines)
+			break
+		}
+
+		aStart, bStart := position(ops, start)
+		var aLen, bLen int
+		for _, o := range ops[start:end] {
+			if o.kind != '+' {
+				aLen++
+			}
+			if o.kind != '-' {
+				bLen++
+			}
+		}
+
+		sb.WriteString(fmt.Sprintf("@@ -%d,%d +%d,%d @@\n", rangeStart(aStart, aLen), aLen, rangeStart(bStart, bLen), bLen))
+		for _, o := range ops[start:end] {
+			sb.WriteByte(o.kind)
+			sb.WriteString(o.line)
+			sb.WriteByte('\n')
+		}
+
+		i = end
+	}
+
+	return sb.String()
+}
+
+// position returns the line offsets within a and b for the given op index.
+func position(ops []op, idx int) (int, int) {
+	var a, b int
+	for _, o := range ops[:idx] {
+		if o.kind != '+' {
+			a++
+		}
+		if o.kind != '-' {
+			b++
+		}
+	}
+
+	return a, b
+}
+
+// rangeStart returns the 1-based first line of a range. An empty range starts at the line before it, e.g. 0 for
+// an empty file.
+func rangeStart(offset, length int) int {
+	if length == 0 {
+		return offset
+	}
+
+	return offset + 1
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	trimmed, ok := strings.CutSuffix(s, "\n")
+	res := strings.Split(trimmed, "\n")
+	if !ok {
+		res[len(res)-1] += noNewline
+	}
+
+	return res
+}
+
+// lines calculates the longest common subsequence and emits the according edit script.
+func lines(a, b []string) []op {
+	n, m := len(a), len(b)
+	lcs := make([][]int32, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, m+1)
+	}
+
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var res []op
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case a[i] == b[j]:
+			res = append(res, op{kind: ' ', line: a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			res = append(res, op{kind: '-', line: a[i]})
+			i++
+		default:
+			res = append(res, op{kind: '+', line: b[j]})
+			j++
+		}
+	}
+
+	for ; i < n; i++ {
+		res = append(res, op{kind: '-', line: a[i]})
+	}
+
+	for ; j < m; j++ {
+		res = append(res, op{kind: '+', line: b[j]})
+	}
+
+	return res
+}
+
+// File compares the current content of the given file with the expected content. A missing file is treated
+// like an empty file. The returned diff is empty, if nothing would change.
+func File(filename string, expected []byte) (string, error) {
+	current, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("cannot read file: %s: %w", filename, err)
+	}
+
+	return Unified(filename, filename, string(current), string(expected)), nil
+}
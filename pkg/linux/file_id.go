@@ -0,0 +1,37 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+//go:build unix
+
+package linux
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// FileID identifies the content of a file by its device, inode, size and modification time. As long as the
+// identity is unchanged, the content is assumed to be unchanged as well, thus it can be used to cache hashes.
+func FileID(info os.FileInfo) (string, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", false
+	}
+
+	return fmt.Sprintf("%d:%d:%d:%d", stat.Dev, stat.Ino, info.Size(), info.ModTime().UnixNano()), true
+}
+
+// LinkCount returns the number of hard links of the file.
+func LinkCount(info os.FileInfo) int {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 1
+	}
+
+	return int(stat.Nlink)
+}
@@ -0,0 +1,22 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+//go:build !unix
+
+package linux
+
+import "os"
+
+// FileID is not supported on this platform, thus hashes are never cached.
+func FileID(info os.FileInfo) (string, bool) {
+	return "", false
+}
+
+// LinkCount always returns 1 on this platform.
+func LinkCount(info os.FileInfo) int {
+	return 1
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package linux
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type Mount struct {
+	Device     string
+	MountPoint string
+	FSType     string
+	Options    []string
+}
+
+// UserQuota returns true, if the filesystem has been mounted with user quota support.
+func (m Mount) UserQuota() bool {
+	return slices.ContainsFunc(m.Options, func(opt string) bool {
+		return opt == "usrquota" || opt == "quota" || strings.HasPrefix(opt, "usrjquota=")
+	})
+}
+
+// GroupQuota returns true, if the filesystem has been mounted with group quota support.
+func (m Mount) GroupQuota() bool {
+	return slices.ContainsFunc(m.Options, func(opt string) bool {
+		return opt == "grpquota" || strings.HasPrefix(opt, "grpjquota=")
+	})
+}
+
+// FindMount returns the mount which contains the given path. The path must exist.
+func FindMount(path string) (Mount, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return Mount{}, fmt.Errorf("cannot resolve path: %s: %w", path, err)
+	}
+
+	buf, err := os.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return Mount{}, fmt.Errorf("cannot read mounts: %w", err)
+	}
+
+	var best Mount
+	for _, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+
+		mp := fields[1]
+		if resolved != mp && !strings.HasPrefix(resolved, strings.TrimSuffix(mp, "/")+"/") {
+			continue
+		}
+
+		// the last and longest match wins, because mounts may shadow each other
+		if len(mp) >= len(best.MountPoint) {
+			best = Mount{
+				Device:     fields[0],
+				MountPoint: mp,
+				FSType:     fields[2],
+				Options:    strings.Split(fields[3], ","),
+			}
+		}
+	}
+
+	if best.MountPoint == "" {
+		return Mount{}, fmt.Errorf("no mount found for path: %s", path)
+	}
+
+	return best, nil
+}
+
+// SetUserQuota sets the hard and soft block limit of the given user (name or numeric id) on the filesystem
+// of the mount point. A limit <= 0 removes the limit.
+func SetUserQuota(user string, limitBytes int64, mountPoint string) error {
+	kib := max(limitBytes, 0) / 1024
+	limit := strconv.FormatInt(kib, 10)
+	cmd := exec.Command("setquota", "-u", user, limit, limit, "0", "0", mountPoint)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("setquota failed: %w: %s", err, string(out))
+	}
+
+	return nil
+}
+
+type QuotaUsage struct {
+	// Used bytes by the user on the filesystem.
+	Used int64
+	// Limit is the hard limit in bytes or 0 if unlimited.
+	Limit int64
+}
+
+// UserQuotaUsage returns the current block usage and limit of the given numeric user id on the filesystem of the
+// given mount point. The report of repquota is parsed, because its columns do not depend on the options.
+func UserQuotaUsage(uid string, mountPoint string) (QuotaUsage, error) {
+	cmd := exec.Command("repquota", "-u", "-n", mountPoint)
+	out, err := cmd.Output()
+	if err != nil {
+		return QuotaUsage{}, fmt.Errorf("repquota failed: %w", err)
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		// #uid flags blocks soft hard [grace] files soft hard [grace]
+		if len(fields) < 5 || fields[0] != "#"+uid {
+			continue
+		}
+
+		used, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return QuotaUsage{}, fmt.Errorf("cannot parse quota blocks: %s", line)
+		}
+
+		limit, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return QuotaUsage{}, fmt.Errorf("cannot parse quota limit: %s", line)
+		}
+
+		return QuotaUsage{Used: used * 1024, Limit: limit * 1024}, nil
+	}
+
+	// repquota omits users, which do not own any blocks and have no limits
+	return QuotaUsage{}, nil
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2025 worldiety GmbH
+//
+// This file is part of the NAGO Low-Code Platform.
+// Licensed under the terms specified in the LICENSE file.
+//
+// SPDX-License-Identifier: Custom-License
+
+package linux
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+)
+
+var overallExposureRegex = regexp.MustCompile(`Overall exposure level for \S+: ([0-9.]+) (\S+)`)
+
+// SecurityCheck is a single sandboxing check of systemd-analyze security.
+type SecurityCheck struct {
+	// Set is nil, if the check does not apply, e.g. because the service runs as root anyway.
+	Set         *bool  `json:"set"`
+	Name        string `json:"name"`
+	JSONField   string `json:"json_field"`
+	Description string `json:"description"`
+	// Exposure is a decimal number or empty, if the check does not contribute to the overall exposure.
+	Exposure string `json:"exposure"`
+}
+
+// Failed returns true, if the check has not been satisfied and increases the exposure.
+func (c SecurityCheck) Failed() bool {
+	if c.Set == nil || *c.Set {
+		return false
+	}
+
+	v, err := strconv.ParseFloat(c.Exposure, 64)
+	return err == nil && v > 0
+}
+
+// SecurityAnalysis is the sandboxing assessment of a service unit.
+type SecurityAnalysis struct {
+	// Exposure ranges from 0.0 (fully sandboxed) to 10.0 (not sandboxed at all).
+	Exposure float64
+	// Level is the textual rating like OK, MEDIUM, EXPOSED or UNSAFE.
+	Level  string
+	Checks []SecurityCheck
+}
+
+// AnalyzeUnitFile runs systemd-analyze security offline for the given unit file, thus the unit does not need to be
+// loaded by systemd. Drop-ins in the directory <filename>.d next to it are taken into account. The overall exposure
+// is not part of the json output, thus it is parsed from the human-readable output.
+func AnalyzeUnitFile(filename string) (SecurityAnalysis, error) {
+	var res SecurityAnalysis
+	args := []string{"security", "--no-pager", "--offline=true"}
+	out, err := exec.Command("systemd-analyze", append(args, filename)...).CombinedOutput()
+	if err != nil {
+		return res, fmt.Errorf("systemd-analyze security failed: %w: %s", err, string(out))
+	}
+
+	m := overallExposureRegex.FindSubmatch(out)
+	if m == nil {
+		return res, fmt.Errorf("cannot find overall exposure level: %s", filename)
+	}
+
+	res.Exposure, err = strconv.ParseFloat(string(m[1]), 64)
+	if err != nil {
+		return res, fmt.Errorf("invalid overall exposure level: %s: %w", string(m[1]), err)
+	}
+
+	res.Level = string(m[2])
+
+	out, err = exec.Command("systemd-analyze", append(args, "--json=short", filename)...).Output()
+	if err != nil {
+		return res, fmt.Errorf("systemd-analyze security --json failed: %w", err)
+	}
+
+	if err := json.Unmarshal(out, &res.Checks); err != nil {
+		return res, fmt.Errorf("cannot parse systemd-analyze security output: %w", err)
+	}
+
+	return res, nil
+}
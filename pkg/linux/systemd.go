@@ -88,3 +88,124 @@ func ServiceStop(name string) error {
 
 	return nil
 }
+
+// ServiceProperties returns the requested properties of the given unit as reported by systemctl show.
+func ServiceProperties(name string, props ...string) (map[string]string, error) {
+	out, err := exec.Command("systemctl", "show", name, "--property="+strings.Join(props, ",")).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to show service properties: %w", err)
+	}
+
+	res := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+
+		res[key] = value
+	}
+
+	return res, nil
+}
+
+// ServicePropertyValues is like ServiceProperties, but keeps every value of properties which are reported once
+// per entry, like IOReadBandwidthMax per device. Empty values are omitted.
+func ServicePropertyValues(name string, props ...string) (map[string][]string, error) {
+	out, err := exec.Command("systemctl", "show", name, "--property="+strings.Join(props, ",")).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to show service properties: %w", err)
+	}
+
+	res := map[string][]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || value == "" {
+			continue
+		}
+
+		res[key] = append(res[key], value)
+	}
+
+	return res, nil
+}
+
+// ActiveUnits returns the names of all active units, which match the given pattern like my-app@*.
+func ActiveUnits(pattern string) ([]string, error) {
+	out, err := exec.Command("systemctl", "list-units", "--plain", "--no-legend", "--state=active", pattern).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list units: %w", err)
+	}
+
+	var res []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			res = append(res, strings.TrimSuffix(fields[0], ".service"))
+		}
+	}
+
+	return res, nil
+}
+
+// ExecStatus is the last outcome of a command of a service like ExecStartPre, as reported by systemctl show.
+type ExecStatus struct {
+	Path string
+	Argv string
+	// Code is e.g. exited, killed or dumped and empty, if the command has not been executed yet.
+	Code   string
+	Status string
+}
+
+// Failed returns true, if the command has been executed and did not exit with status 0.
+func (s ExecStatus) Failed() bool {
+	switch s.Code {
+	case "", "(null)":
+		return false
+	case "exited":
+		return s.Status != "0"
+	default:
+		return true
+	}
+}
+
+// ExecStatuses returns the status of every command of the given property like ExecStartPre. Each command is
+// reported on its own line like { path=/bin/true ; argv[]=/bin/true ; ... ; code=exited ; status=0/SUCCESS }.
+func ExecStatuses(name string, prop string) ([]ExecStatus, error) {
+	out, err := exec.Command("systemctl", "show", name, "--property="+prop).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to show service property: %w", err)
+	}
+
+	var res []ExecStatus
+	for _, line := range strings.Split(string(out), "\n") {
+		value, ok := strings.CutPrefix(line, prop+"=")
+		if !ok {
+			continue
+		}
+
+		value = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(value), "{"), "}"))
+		if value == "" {
+			continue
+		}
+
+		var status ExecStatus
+		for _, field := range strings.Split(value, " ; ") {
+			key, v, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch key {
+			case "path":
+				status.Path = v
+			case "argv[]":
+				status.Argv = v
+			case "code":
+				status.Code = v
+			case "status":
+				status.Status, _, _ = strings.Cut(v, "/")
+			}
+		}
+
+		res = append(res, status)
+	}
+
+	return res, nil
+}
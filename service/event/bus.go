@@ -29,6 +29,15 @@ var (
 	_ = enum.Variant[Event, BackupRequest]()
 	_ = enum.Variant[Event, RestoreRequest]()
 	_ = enum.Variant[Event, ProgressUpdated]()
+	_ = enum.Variant[Event, PlanRequested]()
+	_ = enum.Variant[Event, PlanResponse]()
+	_ = enum.Variant[Event, RollbackPerformed]()
+	_ = enum.Variant[Event, BuildCompleted]()
+	_ = enum.Variant[Event, HealthChanged]()
+	_ = enum.Variant[Event, DriftDetected]()
+	_ = enum.Variant[Event, ApplyCompleted]()
+	_ = enum.Variant[Event, PurgeConfirmed]()
+	_ = enum.Variant[Event, InstancePurged]()
 )
 
 type Bus interface {
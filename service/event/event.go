@@ -41,6 +41,16 @@ type StatisticsUpdated struct {
 	MemTotal    int64        `json:"memTotal,omitempty"`
 	Processes   []Process    `json:"processes,omitempty"`
 	Deployments []Deployment `json:"deployments,omitempty"`
+	Quotas      []QuotaUsage `json:"quotas,omitempty"`
+}
+
+// QuotaUsage describes the used persistent disk space of an instance in relation to its declared quota.
+type QuotaUsage struct {
+	InstanceID string `json:"instanceID"`
+	UID        string `json:"uid"`
+	Used       int64  `json:"used"`
+	// Limit is 0 if unlimited.
+	Limit int64 `json:"limit"`
 }
 
 func (StatisticsUpdated) isEvent() {}
@@ -245,3 +255,271 @@ func (e ProgressUpdated) isEvent() {}
 func (e ProgressUpdated) ReqID() int64 {
 	return 0
 }
+
+// PlanRequested asks the runner to calculate the pending changes of the current configuration without applying
+// them.
+type PlanRequested struct {
+	RequestID int64 `json:"rid"`
+}
+
+func (e PlanRequested) isEvent() {}
+
+type PlanResponse struct {
+	RequestID int64  `json:"rid"`
+	Plan      Plan   `json:"plan"`
+	Error     string `json:"err,omitempty"`
+}
+
+func (e PlanResponse) isEvent() {}
+
+// Plan describes all changes which would be performed, if the configuration is applied.
+type Plan struct {
+	// Purges contains all managed services which are not declared anymore and which are stopped and become
+	// tombstones. Their data is deleted later. Stale units of declared instances only have a UnitFilename, because
+	// their data is kept.
+	Purges      []PurgeChange      `json:"purges,omitempty"`
+	Executables []ExecutableChange `json:"executables,omitempty"`
+	// Restores contains all due declarative restores, which replace the data of an instance.
+	Restores []RestoreChange `json:"restores,omitempty"`
+	// Files contains all generated configuration files like unit files or the Caddyfile which will be rewritten.
+	Files []FileChange `json:"files,omitempty"`
+	// Credentials contains all credential files which will be written or removed. Values are never included.
+	Credentials []CredentialChange `json:"credentials,omitempty"`
+}
+
+// Empty returns true, if applying would not change anything.
+func (p Plan) Empty() bool {
+	return len(p.Purges) == 0 && len(p.Executables) == 0 && len(p.Restores) == 0 && len(p.Files) == 0 && len(p.Credentials) == 0
+}
+
+type CredentialChange struct {
+	InstanceID string `json:"instanceID"`
+	Name       string `json:"name"`
+}
+
+type PurgeChange struct {
+	InstanceID    string `json:"instanceID"`
+	UnitFilename  string `json:"unitFilename"`
+	ExecFilename  string `json:"execFilename"`
+	DataDirectory string `json:"dataDirectory"`
+}
+
+type ExecutableChange struct {
+	InstanceID   string `json:"instanceID"`
+	Filename     string `json:"filename"`
+	URL          string `json:"url"`
+	Size         int64  `json:"size"`
+	CurrentHash  string `json:"currentHash,omitempty"`
+	ExpectedHash string `json:"expectedHash"`
+}
+
+type RestoreChange struct {
+	InstanceID  string `json:"instanceID"`
+	FileSetID   string `json:"fileSetID"`
+	RemoveExtra bool   `json:"removeExtra,omitempty"`
+}
+
+type FileChange struct {
+	Filename string `json:"filename"`
+	// Diff is in the unified diff format.
+	Diff string `json:"diff"`
+}
+
+// RollbackPerformed is published, if an updated service did not become healthy within its grace period and
+// the previous executable and unit file have been put back.
+type RollbackPerformed struct {
+	InstanceID string `json:"instanceID"`
+	Reason     string `json:"reason"`
+	// Error is set, if the rollback itself failed.
+	Error string `json:"err,omitempty"`
+}
+
+func (e RollbackPerformed) isEvent() {}
+
+// BuildCompleted is published after the runner tried to build an executable from the declared sources.
+type BuildCompleted struct {
+	InstanceID string        `json:"instanceID"`
+	AppID      string        `json:"appID"`
+	Commit     string        `json:"commit,omitempty"`
+	Hash       string        `json:"hash,omitempty"`
+	Duration   time.Duration `json:"duration"`
+	// Installed is true, if the build output has been installed as the new executable.
+	Installed bool `json:"installed,omitempty"`
+	// Output of the failed compiler or git invocation.
+	Output string `json:"output,omitempty"`
+	Error  string `json:"err,omitempty"`
+}
+
+func (e BuildCompleted) isEvent() {}
+
+type HealthStatus string
+
+const (
+	Healthy   HealthStatus = "healthy"
+	Unhealthy HealthStatus = "unhealthy"
+)
+
+// HealthChanged is published, whenever the declared health check of an instance changes its state.
+type HealthChanged struct {
+	InstanceID string       `json:"instanceID"`
+	Status     HealthStatus `json:"status"`
+	// Failures is the amount of consecutive failed probes.
+	Failures int `json:"failures,omitempty"`
+	// Error of the last failed probe.
+	Error string `json:"err,omitempty"`
+}
+
+func (e HealthChanged) isEvent() {}
+
+// DriftDetected is published, if the actual state of the runner does not match the last applied configuration
+// anymore.
+type DriftDetected struct {
+	// Plan contains the changes, which are required to reach the configuration again.
+	Plan Plan `json:"plan"`
+	// Services contains all units which should run but have been stopped or disabled.
+	Services []ServiceDrift `json:"services,omitempty"`
+	// Repaired is true, if the configuration has been applied again.
+	Repaired bool `json:"repaired,omitempty"`
+	// Error is set, if the repair has failed.
+	Error string `json:"err,omitempty"`
+}
+
+func (e DriftDetected) isEvent() {}
+
+type ServiceDrift struct {
+	InstanceID string `json:"instanceID"`
+	Unit       string `json:"unit"`
+	// ActiveState as reported by systemd, e.g. inactive or failed.
+	ActiveState string `json:"activeState"`
+	// UnitFileState as reported by systemd, e.g. disabled.
+	UnitFileState string `json:"unitFileState"`
+}
+
+// ApplyCompleted is published after the runner has applied a configuration and reports the outcome of every
+// declared instance.
+type ApplyCompleted struct {
+	StartedAt time.Time     `json:"startedAt"`
+	Duration  time.Duration `json:"duration"`
+	// Instances are in the declared order of the configuration.
+	Instances []InstanceApplied `json:"instances,omitempty"`
+	// Purged contains the undeclared instances, whose data has been deleted. Undeclared instances become
+	// tombstones first, thus their deletion is usually reported later by InstancePurged.
+	Purged []string `json:"purged,omitempty"`
+	// Tombstoned contains the undeclared instances, which have been stopped and whose data is deleted later.
+	Tombstoned []string `json:"tombstoned,omitempty"`
+	// Error is set, if applying has failed as a whole or for any instance.
+	Error string `json:"err,omitempty"`
+}
+
+func (e ApplyCompleted) isEvent() {}
+
+// InstanceApplied describes what has been changed for a single instance.
+type InstanceApplied struct {
+	InstanceID string          `json:"instanceID"`
+	AppID      string          `json:"appID"`
+	Changes    InstanceChanges `json:"changes"`
+	// Restarted contains the units which have been (re)started.
+	Restarted []string `json:"restarted,omitempty"`
+	// RolledBack is true, if the instance did not become healthy and the previous version has been put back.
+	RolledBack bool `json:"rolledBack,omitempty"`
+	// RolledBackHash identifies the declaration, which has been rolled back. It is not applied again, until the
+	// declaration of the instance changes.
+	RolledBackHash string      `json:"rolledBackHash,omitempty"`
+	Steps          []ApplyStep `json:"steps,omitempty"`
+	// Security is the sandboxing audit of the main unit, if it could be analyzed.
+	Security *SecurityAudit `json:"security,omitempty"`
+	// Limits are the effective resource limits of the main unit, if they could be inspected.
+	Limits *ResourceLimits `json:"limits,omitempty"`
+	// Error of the first failed step.
+	Error string `json:"err,omitempty"`
+}
+
+type InstanceChanges struct {
+	Executable  bool `json:"executable,omitempty"`
+	Unit        bool `json:"unit,omitempty"`
+	DropIns     bool `json:"dropIns,omitempty"`
+	Credentials bool `json:"credentials,omitempty"`
+	Socket      bool `json:"socket,omitempty"`
+	Restore     bool `json:"restore,omitempty"`
+	ProxyRules  bool `json:"proxyRules,omitempty"`
+	// Resurrected is true, if the instance has been a tombstone and is started again with its data.
+	Resurrected bool `json:"resurrected,omitempty"`
+	// Timers of changed jobs.
+	Timers []string `json:"timers,omitempty"`
+}
+
+type ApplyStep struct {
+	// Name of the step, e.g. executable, unit or restart.
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"err,omitempty"`
+}
+
+// SecurityAudit is the result of systemd-analyze security for a unit.
+type SecurityAudit struct {
+	Unit string `json:"unit"`
+	// Exposure ranges from 0.0 (fully sandboxed) to 10.0 (not sandboxed at all).
+	Exposure float64 `json:"exposure"`
+	// Level is the rating of systemd like OK, MEDIUM, EXPOSED or UNSAFE.
+	Level string `json:"level"`
+	// FailedChecks contains the names of all unsatisfied checks which increase the exposure, e.g. PrivateTmp=.
+	FailedChecks []string `json:"failedChecks,omitempty"`
+	// Violation is true, if the exposure exceeds the maximum exposure of the runner.
+	Violation bool `json:"violation,omitempty"`
+	// Refused is true, if the unit has been stopped and disabled because of the violation or a failed audit.
+	Refused bool `json:"refused,omitempty"`
+	// Error is set, if the unit could not be audited. The exposure is unknown then.
+	Error string `json:"error,omitempty"`
+}
+
+// ResourceLimits are the effective resource limits of a unit as reported by systemctl show, e.g. infinity for an
+// unset limit. Values which are not reported by the installed systemd version are empty.
+type ResourceLimits struct {
+	Unit       string `json:"unit"`
+	MemoryHigh string `json:"memoryHigh,omitempty"`
+	MemoryMax  string `json:"memoryMax,omitempty"`
+	// EffectiveMemoryMax also respects the limits of the slices above the unit.
+	EffectiveMemoryMax string `json:"effectiveMemoryMax,omitempty"`
+	TasksMax           string `json:"tasksMax,omitempty"`
+	// EffectiveTasksMax also respects the limits of the slices above the unit.
+	EffectiveTasksMax string `json:"effectiveTasksMax,omitempty"`
+	IOWeight          string `json:"IOWeight,omitempty"`
+	// IOReadBandwidthMax and IOWriteBandwidthMax contain a device and its bandwidth in bytes per second each.
+	IOReadBandwidthMax  []string `json:"IOReadBandwidthMax,omitempty"`
+	IOWriteBandwidthMax []string `json:"IOWriteBandwidthMax,omitempty"`
+	// LimitNOFILE is the hard limit of open file descriptors, LimitNOFILESoft the soft limit.
+	LimitNOFILE     string `json:"limitNOFILE,omitempty"`
+	LimitNOFILESoft string `json:"limitNOFILESoft,omitempty"`
+	// CPUQuotaPerSecUSec is the CPU time per second, e.g. 2s for CPUQuota=200%.
+	CPUQuotaPerSecUSec string `json:"CPUQuotaPerSecUSec,omitempty"`
+	CPUAffinity        string `json:"CPUAffinity,omitempty"`
+}
+
+// Tombstone is an instance, which is not declared anymore and whose services have been stopped. Its data is kept
+// until PurgeAfter has passed and the final backup has succeeded, or until the hub confirms the purge.
+type Tombstone struct {
+	InstanceID  string    `json:"instanceID"`
+	Since       time.Time `json:"since"`
+	PurgeAfter  time.Time `json:"purgeAfter"`
+	BackedUpAt  time.Time `json:"backedUpAt,omitzero"`
+	BackupError string    `json:"backupErr,omitempty"`
+	Confirmed   bool      `json:"confirmed,omitempty"`
+}
+
+// PurgeConfirmed is sent by the hub to delete the data of a tombstone immediately, without waiting for the grace
+// period or the final backup.
+type PurgeConfirmed struct {
+	InstanceID string `json:"instanceID"`
+}
+
+func (e PurgeConfirmed) isEvent() {}
+
+// InstancePurged is published after the data of a tombstone has been deleted.
+type InstancePurged struct {
+	InstanceID string    `json:"instanceID"`
+	Confirmed  bool      `json:"confirmed,omitempty"`
+	BackedUpAt time.Time `json:"backedUpAt,omitzero"`
+	Error      string    `json:"err,omitempty"`
+}
+
+func (e InstancePurged) isEvent() {}
@@ -46,9 +46,12 @@ func NewDoBackup(settings setup.Settings, bus event.Bus) DoBackup {
 			backup.Exec = file
 		}
 
+		// a backup without its data must never be reported as a success, otherwise the data may be purged. A
+		// stateless instance has no data dir at all, which is backed up like an empty one.
 		dataDir := filepath.Join(dataPrefix, req.InstanceID)
-		if _, err := os.Stat(dataDir); os.IsNotExist(err) {
-			slog.Warn("data dir does not exist", "dir", dataDir)
+		if _, err := os.Stat(dataDir); err != nil && !os.IsNotExist(err) {
+			slog.Error("cannot backup data dir", "dir", dataDir, "err", err.Error())
+			errs = append(errs, fmt.Errorf("cannot backup data dir: %w", err))
 		}
 		fsys := os.DirFS(dataDir)
 		filesCount := countFiles(fsys) + 2 // 1 for executable and 1 for the commit
@@ -56,6 +59,11 @@ func NewDoBackup(settings setup.Settings, bus event.Bus) DoBackup {
 
 		err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
 			if err != nil {
+				// a missing data dir or a file, which has been deleted meanwhile, has nothing to back up
+				if os.IsNotExist(err) {
+					return nil
+				}
+
 				slog.Error("failed to walk dir", "path", path, "err", err.Error())
 				return err
 			}
@@ -84,10 +92,12 @@ func NewDoBackup(settings setup.Settings, bus event.Bus) DoBackup {
 
 		if err != nil {
 			slog.Error("failed to backup data dir", "dir", dataDir, "err", err.Error())
+			errs = append(errs, fmt.Errorf("failed to backup data dir: %w", err))
 		}
 
 		if err := bc.CommitBackup(backup); err != nil {
 			slog.Error("failed to commit backup", "err", err.Error())
+			errs = append(errs, fmt.Errorf("failed to commit backup: %w", err))
 		} else {
 			slog.Info("backup completed", "instance", req.InstanceID, "errors", len(errs))
 		}
@@ -8,6 +8,7 @@
 package service
 
 import (
+	"github.com/worldiety/nago-runner/apply/systemd"
 	"github.com/worldiety/nago-runner/pkg/linux"
 	"github.com/worldiety/nago-runner/service/event"
 	"log/slog"
@@ -23,6 +24,8 @@ func NewStatistics() Statistics {
 		memTotal, _ := linux.MemoryTotal()
 		res.MemTotal = memTotal
 
+		res.Quotas = quotaUsages()
+
 		entries, err := os.ReadDir("/proc")
 		if err != nil {
 			slog.Error("Error reading /proc", "err", err.Error())
@@ -64,3 +67,29 @@ func isNumericDir(name string) bool {
 	_, err := strconv.Atoi(name)
 	return err == nil
 }
+
+// quotaUsages reports the disk usage of all managed services which declare a quota.
+func quotaUsages() []event.QuotaUsage {
+	services, err := systemd.FindServices(slog.Default())
+	if err != nil {
+		slog.Error("cannot find services for quota usage", "err", err.Error())
+		return nil
+	}
+
+	var res []event.QuotaUsage
+	for _, service := range services {
+		if !service.Managed || service.Job != "" || service.Type() != "service" || !service.Application.Sandbox.Filesystem.Enabled {
+			continue
+		}
+
+		usage, err := systemd.QuotaUsage(service)
+		if err != nil {
+			slog.Error("cannot query quota usage", "service", service.Name(), "err", err.Error())
+			continue
+		}
+
+		res = append(res, usage)
+	}
+
+	return res
+}